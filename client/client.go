@@ -1,76 +1,174 @@
 package client
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
-	"net/http/httputil"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/yamux"
+	"github.com/samalba/skyproxy/control"
+	"github.com/samalba/skyproxy/logging"
+	"github.com/samalba/skyproxy/metrics"
 	"github.com/samalba/skyproxy/utils"
 )
 
+// DefaultMaxStreams is the maximum number of streams handled concurrently when
+// Client.MaxStreams is not set
+const DefaultMaxStreams = 100
+
+// DefaultShutdownTimeout is the maximum time given to the in-flight streams to
+// complete on shutdown
+const DefaultShutdownTimeout = 30 * time.Second
+
+var errConnectionLost = errors.New("Connection to the server lost")
+
 // Client handles the client connection
 type Client struct {
-	HTTPHost string
-	tcpConn  net.Conn
-	tlsConn  *tls.Conn
+	// HTTPHosts are registered on the server, all of them share the same
+	// session
+	HTTPHosts []string
+	// Routes forward the requests to a receiver depending on their Host and
+	// path, the requests matching no route are forwarded to the address given
+	// to Tunnel
+	Routes []Route
+	// Mode is the kind of traffic tunneled: utils.ModeHTTP (the default),
+	// utils.ModeTCP or utils.ModeUDP to register a port instead of HTTP hosts,
+	// or utils.ModeTLS to receive the TLS connections for the HTTPHosts
+	// without the server terminating them. The connections are forwarded as is
+	// to the receiver in the TCP and TLS modes, the datagrams to a UDP
+	// receiver in the UDP mode.
+	Mode string
+	// TCPPort and UDPPort are the requested port in the TCP and UDP modes, the
+	// server assigns one when it is 0 (see Registration) and it is requested
+	// again on reconnect
+	TCPPort int
+	UDPPort int
+	// UDPIdleTimeout is the time after which a UDP flow without traffic is
+	// closed (DefaultUDPIdleTimeout if not set)
+	UDPIdleTimeout time.Duration
+	// Token is sent to the server to authorize the registration
+	Token string
+	// Weight is advertised to the server for the weighted balancer, the server
+	// uses 1 when it is not set
+	Weight int
+	// HealthPath is requested by the server health checks through the tunnel,
+	// the server only pings the session when it is not set. It is also used
+	// to check the receivers locally. It is ignored in the TCP and TLS modes.
+	HealthPath string
+	// ReceiverCheckInterval is the interval between two checks of the
+	// receivers, their readiness is reported to the server
+	ReceiverCheckInterval time.Duration
+	// MaxStreams is the maximum number of streams forwarded concurrently to the
+	// receiver. New streams are not accepted while the limit is reached.
+	MaxStreams int
+	// MinRetryDelay and MaxRetryDelay bound the delay between two
+	// reconnection attempts in Run
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+	// OnStateChange is called on every state transition in Run, err is set
+	// when the transition is caused by an error
+	OnStateChange func(state State, err error)
+	// Logger receives the logs of the Client, logging.Default() is used when
+	// it is not set
+	Logger       logging.Logger
+	conn         net.Conn
+	registration *utils.RegisterResponse
+	session      *yamux.Session
+	control      *control.Conn
+	lock         sync.Mutex
+	draining     bool
+	shutdown     chan struct{}
+	stats        streamStats
+	metrics      *metrics.Registry
 }
 
 // TLSConfig is used by the HTTP client
 type TLSConfig struct {
+	// CAFile is used to verify the server certificate, the system roots are
+	// used when it is not set
 	CAFile string
+	// CertFile and KeyFile are the client certificate sent to the server
+	CertFile string
+	KeyFile  string
 }
 
-// Connect to a skyproxy server
+// Connect to a skyproxy server and registers the HTTP host. A *RegisterError
+// is returned if the server rejects the registration.
 func (c *Client) Connect(address string, tlsConfig *TLSConfig) error {
 	var (
-		err        error
-		httpClient *httputil.ClientConn
+		err  error
+		conn net.Conn
 	)
 	if tlsConfig != nil {
-		var conn *tls.Conn
 		conn, err = c.connectTLS(address, tlsConfig)
-		httpClient = httputil.NewClientConn(conn, nil)
-		c.tlsConn = conn
 	} else {
-		var conn net.Conn
 		conn, err = c.connect(address)
-		httpClient = httputil.NewClientConn(conn, nil)
-		c.tcpConn = conn
-	}
-	if err != nil {
-		return err
 	}
-	req, err := http.NewRequest("POST", "/_skyproxy/register", nil)
 	if err != nil {
 		return err
 	}
-	req.Host = c.HTTPHost
-	req.Header.Add("X-Skyproxy-Client-Version", "0.1")
-	err = httpClient.Write(req)
+	resp, bufConn, err := c.register(conn)
 	if err != nil {
-		httpClient.Close()
+		conn.Close()
 		return err
 	}
+	c.lock.Lock()
+	c.conn = bufConn
+	c.registration = resp
+	c.lock.Unlock()
 	return nil
 }
 
+// logger returns the Logger of the Client, with the session ID of the last
+// registration
+func (c *Client) logger() logging.Logger {
+	logger := c.Logger
+	if logger == nil {
+		logger = logging.Default()
+	}
+	if registration := c.Registration(); registration != nil {
+		return logger.With("client_id", registration.SessionID)
+	}
+	return logger
+}
+
+// Registration returns the server reply to the last successful registration
+func (c *Client) Registration() *utils.RegisterResponse {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.registration
+}
+
 func (c *Client) connectTLS(address string, tlsConfig *TLSConfig) (*tls.Conn, error) {
-	roots := x509.NewCertPool()
-	certData, err := ioutil.ReadFile(tlsConfig.CAFile)
-	if err != nil {
-		return nil, err
+	config := &tls.Config{}
+	if tlsConfig.CAFile != "" {
+		roots := x509.NewCertPool()
+		certData, err := ioutil.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if ok := roots.AppendCertsFromPEM(certData); ok != true {
+			return nil, fmt.Errorf("Cannot read parse CA certificate")
+		}
+		config.RootCAs = roots
 	}
-	if ok := roots.AppendCertsFromPEM(certData); ok != true {
-		return nil, fmt.Errorf("Cannot read parse CA certificate")
+	if tlsConfig.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Cannot load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
 	}
-	return tls.Dial("tcp", address, &tls.Config{RootCAs: roots})
+	return tls.Dial("tcp", address, config)
 }
 
 func (c *Client) connect(address string) (net.Conn, error) {
@@ -91,27 +189,183 @@ func (c *Client) Tunnel(address string) {
 		err     error
 		session *yamux.Session
 	)
-	if c.tlsConn != nil {
-		session, err = yamux.Server(c.tlsConn, nil)
-	} else {
-		session, err = yamux.Server(c.tcpConn, nil)
+	session, err = yamux.Server(c.conn, nil)
+	if err != nil {
+		c.logger().Error("Cannot init Yamux Server session", "error", err)
+		return
+	}
+	c.lock.Lock()
+	if c.draining {
+		// Shutdown returned before the session existed
+		c.lock.Unlock()
+		session.Close()
+		return
 	}
+	c.session = session
+	c.lock.Unlock()
+	ctrl, err := c.openControl(session)
 	if err != nil {
-		log.Printf("Cannot init Yamux Server session: %s", err)
+		c.logger().Error("Cannot open the control stream", "error", err)
+		session.Close()
 		return
 	}
+	c.lock.Lock()
+	c.control = ctrl
+	c.lock.Unlock()
+	go c.monitorReceivers(session, ctrl, address)
+	maxStreams := c.MaxStreams
+	if maxStreams <= 0 {
+		maxStreams = DefaultMaxStreams
+	}
+	// Each slot of the semaphore is an in-flight stream
+	sem := make(chan struct{}, maxStreams)
 	for {
-		stream, err := session.Accept()
+		select {
+		case sem <- struct{}{}:
+		default:
+			// Stop accepting until a slot is freed, the new streams queue in the
+			// Yamux accept backlog meanwhile. The server only blocks on opening
+			// streams once the backlog is full.
+			c.logger().Warn("Reached the maximum of concurrent streams, waiting", "max_streams", maxStreams)
+			sem <- struct{}{}
+		}
+		stream, err := session.AcceptStream()
 		if err != nil {
-			log.Printf("Cannot accept a new Yamux stream: %s. The server might have stopped responding.", err)
+			<-sem
+			if c.isDraining() {
+				c.logger().Info("Yamux session closed")
+				return
+			}
+			c.logger().Warn("Cannot accept a new Yamux stream, the server might have stopped responding", "error", err)
 			return
 		}
-		conn, err := net.Dial("tcp", address)
+		// The streams accepted while draining are forwarded too, the server
+		// opened them before it was told about the drain
+		go func() {
+			defer func() { <-sem }()
+			c.forwardStream(stream, address)
+		}()
+	}
+}
+
+// forwardStream tunnels a single stream to the receiver
+func (c *Client) forwardStream(stream *yamux.Stream, address string) {
+	log := c.logger().With("stream_id", stream.StreamID())
+	if c.Mode == utils.ModeUDP {
+		c.forwardUDP(log, stream, address)
+		return
+	}
+	var head []byte
+	if len(c.Routes) > 0 && c.httpMode() {
+		// Read the request headers to find the route, the bytes read are
+		// replayed to the receiver
+		buf := &bytes.Buffer{}
+		req, err := http.ReadRequest(bufio.NewReader(io.TeeReader(stream, buf)))
 		if err != nil {
-			log.Printf("Cannot connect to receiver: %s", err)
+			log.Warn("Cannot read the request", "error", err)
 			stream.Close()
-			continue
+			return
+		}
+		if receiver, found := findReceiver(c.Routes, req.Host, req.URL.Path); found {
+			address = receiver
+		}
+		head = buf.Bytes()
+	}
+	if address == "" {
+		log.Warn("No receiver for the request")
+		io.WriteString(stream, "HTTP/1.1 502 Bad Gateway\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		stream.Close()
+		return
+	}
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		log.Error("Cannot connect to receiver", "receiver", address, "error", err)
+		stream.Close()
+		return
+	}
+	if _, err := conn.Write(head); err != nil {
+		log.Error("Cannot write to receiver", "receiver", address, "error", err)
+		conn.Close()
+		stream.Close()
+		return
+	}
+	start := time.Now()
+	c.stats.streamStarted()
+	bytesOut, bytesIn := utils.TunnelConn(stream, conn, true)
+	bytesIn += int64(len(head))
+	c.stats.streamDone(bytesIn, bytesOut)
+	log.Debug("Stream forwarded", "receiver", address, "bytes_in", bytesIn, "bytes", bytesOut,
+		"duration", time.Since(start))
+}
+
+// httpMode returns true if the Client tunnels HTTP requests
+func (c *Client) httpMode() bool {
+	return c.Mode == "" || c.Mode == utils.ModeHTTP
+}
+
+// shutdownChan returns a channel closed by Shutdown
+func (c *Client) shutdownChan() chan struct{} {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.shutdown == nil {
+		c.shutdown = make(chan struct{})
+	}
+	return c.shutdown
+}
+
+func (c *Client) isDraining() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.draining
+}
+
+// Shutdown stops accepting new streams, waits for the in-flight ones to
+// complete (or for the timeout to expire) and closes the session
+func (c *Client) Shutdown(timeout time.Duration) error {
+	shutdown := c.shutdownChan()
+	c.lock.Lock()
+	session := c.session
+	ctrl := c.control
+	if !c.draining {
+		c.draining = true
+		close(shutdown)
+	}
+	c.lock.Unlock()
+	if session == nil {
+		// Tunnel closes the session if it is created later
+		return nil
+	}
+	// Tell the server to stop selecting the Client, then to stop opening new
+	// streams. The GoAway is only sent once the server acknowledged the
+	// drain, the streams it is still opening meanwhile are accepted.
+	if ctrl != nil {
+		drain := &control.Drain{Reason: "Client shutting down", Timeout: int(timeout.Seconds())}
+		if _, err := ctrl.Request(control.TypeDrain, drain, controlDrainTimeout); err != nil {
+			c.logger().Warn("The server did not acknowledge the drain", "error", err)
+		}
+	}
+	if err := session.GoAway(); err != nil {
+		c.logger().Warn("Cannot notify the server", "error", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		// A stream is open until both sides closed it, the server closes its
+		// side once it read the response. Closing the session before would
+		// reset the unread responses.
+		open := 0
+		if ctrl != nil {
+			open = 1
+		}
+		for session.NumStreams() > open && !session.IsClosed() {
+			time.Sleep(10 * time.Millisecond)
 		}
-		utils.TunnelConn(stream, conn, true)
+		close(done)
+	}()
+	select {
+	case <-done:
+		c.logger().Info("All streams drained")
+	case <-time.After(timeout):
+		c.logger().Warn("Timeout reached while draining the streams, closing anyway", "timeout", timeout)
 	}
+	return session.Close()
 }
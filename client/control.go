@@ -0,0 +1,128 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/samalba/skyproxy/control"
+	"github.com/samalba/skyproxy/utils"
+)
+
+// controlHelloTimeout is the time given to the server to reply to the hello
+const controlHelloTimeout = 10 * time.Second
+
+// controlDrainTimeout is the time given to the server to acknowledge the drain
+// on shutdown
+const controlDrainTimeout = 5 * time.Second
+
+// streamStats counts the streams forwarded by the Client
+type streamStats struct {
+	lock     sync.Mutex
+	active   int64
+	total    uint64
+	bytesIn  uint64
+	bytesOut uint64
+	ready    bool
+	// state and registrations are updated by Run
+	state         State
+	registrations uint64
+}
+
+func (s *streamStats) streamStarted() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.active++
+	s.total++
+}
+
+func (s *streamStats) streamDone(bytesIn, bytesOut int64) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.active--
+	s.bytesIn += uint64(bytesIn)
+	s.bytesOut += uint64(bytesOut)
+}
+
+func (s *streamStats) setReady(ready bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.ready = ready
+}
+
+// Stats returns the statistics of the Client
+func (c *Client) Stats() control.Stats {
+	c.stats.lock.Lock()
+	defer c.stats.lock.Unlock()
+	return control.Stats{
+		ActiveStreams: c.stats.active,
+		TotalStreams:  c.stats.total,
+		BytesIn:       c.stats.bytesIn,
+		BytesOut:      c.stats.bytesOut,
+		Ready:         c.stats.ready,
+		Draining:      c.isDraining(),
+	}
+}
+
+// openControl opens the control stream of a session and exchanges the hello
+// messages with the server
+func (c *Client) openControl(session *yamux.Session) (*control.Conn, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	ctrl := control.NewConn(stream)
+	stream.SetDeadline(time.Now().Add(controlHelloTimeout))
+	if err := ctrl.Send(control.TypeHello, &control.Hello{SkyproxyVersion: utils.Version}); err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	msg, err := ctrl.Receive()
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	if msg.Type != control.TypeHello {
+		ctrl.Close()
+		return nil, fmt.Errorf("Unexpected control message %q, expected %q", msg.Type, control.TypeHello)
+	}
+	stream.SetDeadline(time.Time{})
+	go ctrl.Serve(func(msg *control.Message) {
+		c.handleControl(ctrl, msg)
+	})
+	return ctrl, nil
+}
+
+// handleControl handles the messages sent by the server
+func (c *Client) handleControl(ctrl *control.Conn, msg *control.Message) {
+	switch msg.Type {
+	case control.TypeStatsRequest:
+		ctrl.Reply(msg, control.TypeStats, c.Stats())
+	case control.TypeDrain:
+		if msg.ReplyTo != 0 {
+			// Late acknowledgement of the drain sent by Shutdown
+			return
+		}
+		var drain control.Drain
+		msg.Decode(&drain)
+		c.logger().Info("The server is draining the session", "reason", drain.Reason)
+	case control.TypeReconfigure:
+		var conf control.Reconfigure
+		if err := msg.Decode(&conf); err != nil {
+			ctrl.Reply(msg, control.TypeError, &control.Error{Message: err.Error()})
+			return
+		}
+		if conf.ReceiverCheckInterval > 0 {
+			interval := time.Duration(conf.ReceiverCheckInterval) * time.Millisecond
+			c.logger().Info("Receiver check interval set by the server", "interval", interval)
+			c.lock.Lock()
+			c.ReceiverCheckInterval = interval
+			c.lock.Unlock()
+		}
+	default:
+		ctrl.Reply(msg, control.TypeError, &control.Error{
+			Message: fmt.Sprintf("Unsupported message type %q", msg.Type),
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package client
+
+import (
+	"net/http"
+
+	"github.com/samalba/skyproxy/metrics"
+)
+
+// Metrics returns the metrics of the Client
+func (c *Client) Metrics() *metrics.Registry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.metrics != nil {
+		return c.metrics
+	}
+	r := metrics.NewRegistry()
+	// stat reads a value of the stats under their lock
+	stat := func(fn func(s *streamStats) float64) func() float64 {
+		return func() float64 {
+			c.stats.lock.Lock()
+			defer c.stats.lock.Unlock()
+			return fn(&c.stats)
+		}
+	}
+	r.NewGaugeFunc("skyproxy_client_connected",
+		"1 if the Client is registered on the server",
+		stat(func(s *streamStats) float64 { return boolValue(s.state == StateRegistered) }))
+	r.NewCounterFunc("skyproxy_client_registrations_total",
+		"Number of successful registrations on the server, including the reconnections",
+		stat(func(s *streamStats) float64 { return float64(s.registrations) }))
+	r.NewGaugeFunc("skyproxy_client_receivers_ready",
+		"1 if the receivers are ready",
+		stat(func(s *streamStats) float64 { return boolValue(s.ready) }))
+	r.NewGaugeFunc("skyproxy_client_streams_active",
+		"Number of streams being forwarded to the receivers",
+		stat(func(s *streamStats) float64 { return float64(s.active) }))
+	r.NewCounterFunc("skyproxy_client_streams_total",
+		"Number of streams forwarded to the receivers",
+		stat(func(s *streamStats) float64 { return float64(s.total) }))
+	r.NewCounterFunc("skyproxy_client_tunnel_received_bytes_total",
+		"Number of bytes received from the server and sent to the receivers",
+		stat(func(s *streamStats) float64 { return float64(s.bytesIn) }))
+	r.NewCounterFunc("skyproxy_client_tunnel_sent_bytes_total",
+		"Number of bytes received from the receivers and sent to the server",
+		stat(func(s *streamStats) float64 { return float64(s.bytesOut) }))
+	c.metrics = r
+	return r
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// ServeMetrics exports the metrics of the Client on /metrics
+func (c *Client) ServeMetrics(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c.Metrics().Handler())
+	return http.ListenAndServe(address, mux)
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/samalba/skyproxy/control"
+	"github.com/samalba/skyproxy/utils"
+)
+
+const (
+	// DefaultReceiverCheckInterval is the interval between two checks of the
+	// receivers when Client.ReceiverCheckInterval is not set
+	DefaultReceiverCheckInterval = 5 * time.Second
+	// receiverCheckTimeout is the timeout of a receiver check
+	receiverCheckTimeout = 3 * time.Second
+)
+
+// receiverAddresses returns the addresses of all the receivers, without
+// duplicates
+func (c *Client) receiverAddresses(address string) []string {
+	addresses := []string{}
+	seen := make(map[string]bool)
+	if address != "" {
+		addresses = append(addresses, address)
+		seen[address] = true
+	}
+	for _, route := range c.Routes {
+		if !seen[route.Receiver] {
+			addresses = append(addresses, route.Receiver)
+			seen[route.Receiver] = true
+		}
+	}
+	return addresses
+}
+
+// checkReceiver connects to a receiver, or requests its HealthPath when set
+// in the HTTP mode. A UDP receiver cannot be checked, only its address is
+// resolved.
+func (c *Client) checkReceiver(address string) error {
+	if c.Mode == utils.ModeUDP {
+		_, err := net.ResolveUDPAddr("udp", address)
+		return err
+	}
+	if c.HealthPath == "" || !c.httpMode() {
+		conn, err := net.DialTimeout("tcp", address, receiverCheckTimeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	httpClient := &http.Client{Timeout: receiverCheckTimeout}
+	resp, err := httpClient.Get("http://" + address + c.HealthPath)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("%s%s returned %s", address, c.HealthPath, resp.Status)
+	}
+	return nil
+}
+
+// receiversStatus checks all the receivers, they are ready only if all of
+// them pass the check
+func (c *Client) receiversStatus(addresses []string) control.Status {
+	for _, address := range addresses {
+		if err := c.checkReceiver(address); err != nil {
+			return control.Status{Ready: false, Reason: err.Error()}
+		}
+	}
+	return control.Status{Ready: true}
+}
+
+// receiverCheckInterval returns the interval between two checks, it can be
+// changed by the server
+func (c *Client) receiverCheckInterval() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.ReceiverCheckInterval <= 0 {
+		return DefaultReceiverCheckInterval
+	}
+	return c.ReceiverCheckInterval
+}
+
+// monitorReceivers checks the receivers periodically and reports their
+// readiness to the server until the session is closed
+func (c *Client) monitorReceivers(session *yamux.Session, ctrl *control.Conn, address string) {
+	addresses := c.receiverAddresses(address)
+	var last *control.Status
+	for !session.IsClosed() {
+		status := c.receiversStatus(addresses)
+		if last == nil || status.Ready != last.Ready {
+			if status.Ready {
+				c.logger().Info("Receivers ready")
+			} else {
+				c.logger().Warn("Receivers not ready", "reason", status.Reason)
+			}
+			c.stats.setReady(status.Ready)
+			if err := ctrl.Send(control.TypeStatus, &status); err != nil {
+				c.logger().Warn("Cannot report the receivers status", "error", err)
+				return
+			}
+			last = &status
+		}
+		time.Sleep(c.receiverCheckInterval())
+	}
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// State is the connection state of a Client
+type State int
+
+const (
+	// StateConnecting is set while dialing and registering to the server
+	StateConnecting State = iota
+	// StateRegistered is set once the hosts are registered and the traffic is
+	// being forwarded
+	StateRegistered
+	// StateDisconnected is set when the connection is lost or cannot be
+	// established
+	StateDisconnected
+)
+
+func (s State) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateRegistered:
+		return "registered"
+	case StateDisconnected:
+		return "disconnected"
+	}
+	return "unknown"
+}
+
+const (
+	// DefaultMinRetryDelay is the delay before the first reconnection attempt
+	DefaultMinRetryDelay = 500 * time.Millisecond
+	// DefaultMaxRetryDelay is the maximum delay between two reconnection
+	// attempts
+	DefaultMaxRetryDelay = 30 * time.Second
+)
+
+// retryDelay returns the delay before the given reconnection attempt. The
+// delay grows exponentially up to maxDelay, half of it is randomized to avoid
+// all the clients reconnecting at once after a server restart.
+func retryDelay(attempt int, minDelay, maxDelay time.Duration) time.Duration {
+	delay := minDelay
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// setState logs the state transition and calls the OnStateChange hook
+func (c *Client) setState(state State, err error) {
+	c.stats.lock.Lock()
+	c.stats.state = state
+	if state == StateRegistered {
+		c.stats.registrations++
+	}
+	c.stats.lock.Unlock()
+	if err != nil {
+		c.logger().Warn("State changed", "state", state, "error", err)
+	} else {
+		c.logger().Info("State changed", "state", state)
+	}
+	if c.OnStateChange != nil {
+		c.OnStateChange(state, err)
+	}
+}
+
+// Run connects to the server and forwards the traffic to the receiver. When
+// the connection is lost, it reconnects with a jittered exponential backoff
+// and registers the hosts again. It returns nil after a Shutdown, or the
+// error if the server rejects the registration for a non-temporary reason.
+func (c *Client) Run(address string, tlsConfig *TLSConfig, receiver string) error {
+	minDelay := c.MinRetryDelay
+	if minDelay <= 0 {
+		minDelay = DefaultMinRetryDelay
+	}
+	maxDelay := c.MaxRetryDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultMaxRetryDelay
+	}
+	attempt := 0
+	for !c.isDraining() {
+		c.setState(StateConnecting, nil)
+		err := c.Connect(address, tlsConfig)
+		if err == nil && c.isDraining() {
+			// Shutdown was called while connecting
+			c.conn.Close()
+			c.setState(StateDisconnected, nil)
+			return nil
+		}
+		if err == nil {
+			attempt = 0
+			c.setState(StateRegistered, nil)
+			if port := c.Registration().TCPPort; port != 0 {
+				c.logger().Info("TCP port registered", "port", port)
+			}
+			if port := c.Registration().UDPPort; port != 0 {
+				c.logger().Info("UDP port registered", "port", port)
+			}
+			c.Tunnel(receiver)
+			if c.isDraining() {
+				c.setState(StateDisconnected, nil)
+				return nil
+			}
+			err = errConnectionLost
+		}
+		c.setState(StateDisconnected, err)
+		if regErr, ok := err.(*RegisterError); ok && !regErr.Temporary() {
+			return err
+		}
+		delay := retryDelay(attempt, minDelay, maxDelay)
+		attempt++
+		c.logger().Info("Reconnecting", "delay", delay)
+		select {
+		case <-time.After(delay):
+		case <-c.shutdownChan():
+		}
+	}
+	return nil
+}
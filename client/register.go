@@ -0,0 +1,135 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/samalba/skyproxy/utils"
+)
+
+// maxRegisterResponseSize limits the size of the handshake response body
+const maxRegisterResponseSize = 64 * 1024
+
+// RegisterError is returned when the server rejects the registration
+type RegisterError struct {
+	// StatusCode is the HTTP status code of the server reply
+	StatusCode int
+	// Code is one of the utils.Reject* constants when the server sent one
+	Code   string
+	Reason string
+}
+
+func (e *RegisterError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("Registration rejected by the server (%d): %s", e.StatusCode, e.Reason)
+	}
+	return fmt.Sprintf("Registration rejected by the server (%s): %s", e.Code, e.Reason)
+}
+
+// Temporary returns true if the registration might succeed if retried later
+func (e *RegisterError) Temporary() bool {
+	return e.Code == utils.RejectInternalError || e.StatusCode >= 500
+}
+
+// register sends the registration request and waits for the server reply. On
+// success, the returned conn must be used instead of the original one since
+// some of the Yamux traffic might be buffered already.
+func (c *Client) register(conn net.Conn) (*utils.RegisterResponse, net.Conn, error) {
+	req, err := http.NewRequest("POST", "/_skyproxy/register", nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch c.Mode {
+	case utils.ModeTCP:
+		req.Host = utils.ProtocolName
+		req.Header.Set(utils.ModeHeader, utils.ModeTCP)
+		port := c.TCPPort
+		if port == 0 && c.Registration() != nil {
+			// Keep the port assigned on the first registration when
+			// reconnecting
+			port = c.Registration().TCPPort
+		}
+		req.Header.Set(utils.TCPPortHeader, strconv.Itoa(port))
+	case utils.ModeUDP:
+		req.Host = utils.ProtocolName
+		req.Header.Set(utils.ModeHeader, utils.ModeUDP)
+		port := c.UDPPort
+		if port == 0 && c.Registration() != nil {
+			// Keep the port assigned on the first registration when
+			// reconnecting
+			port = c.Registration().UDPPort
+		}
+		req.Header.Set(utils.UDPPortHeader, strconv.Itoa(port))
+	case "", utils.ModeHTTP, utils.ModeTLS:
+		if len(c.HTTPHosts) == 0 {
+			return nil, nil, fmt.Errorf("No HTTP host to register")
+		}
+		req.Host = c.HTTPHosts[0]
+		req.Header.Set(utils.HostsHeader, strings.Join(c.HTTPHosts, ","))
+		if c.Mode == utils.ModeTLS {
+			req.Header.Set(utils.ModeHeader, utils.ModeTLS)
+		}
+	default:
+		return nil, nil, fmt.Errorf("Unknown mode %q", c.Mode)
+	}
+	req.Header.Set(utils.ClientVersionHeader, utils.Version)
+	req.Header.Set(utils.ProtocolVersionHeader, strconv.Itoa(utils.ProtocolVersion))
+	if c.Weight > 0 {
+		req.Header.Set(utils.WeightHeader, strconv.Itoa(c.Weight))
+	}
+	if c.HealthPath != "" && c.httpMode() {
+		req.Header.Set(utils.HealthPathHeader, c.HealthPath)
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", fmt.Sprintf("%s/%d", utils.ProtocolName, utils.ProtocolVersion))
+	if err := req.Write(conn); err != nil {
+		return nil, nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot read the registration response: %s", err)
+	}
+	// The body of a 101 response is not read by net/http, its length is taken
+	// from the header and the body is read directly from the connection
+	var body io.Reader = resp.Body
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		length, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		if err != nil || length > maxRegisterResponseSize {
+			return nil, nil, fmt.Errorf("Invalid registration response length: %q", resp.Header.Get("Content-Length"))
+		}
+		body = io.LimitReader(reader, length)
+	} else {
+		defer resp.Body.Close()
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(body, maxRegisterResponseSize))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Cannot read the registration response: %s", err)
+	}
+	regResp := &utils.RegisterResponse{}
+	if err := json.Unmarshal(data, regResp); err != nil {
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			return nil, nil, fmt.Errorf("Cannot decode the registration response: %s", err)
+		}
+		// Not a Skyproxy server or an older version
+		return nil, nil, &RegisterError{StatusCode: resp.StatusCode, Reason: resp.Status}
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || !regResp.Accepted {
+		return nil, nil, &RegisterError{
+			StatusCode: resp.StatusCode,
+			Code:       regResp.Code,
+			Reason:     regResp.Reason,
+		}
+	}
+	return regResp, &utils.BufferedConn{Conn: conn, Reader: reader}, nil
+}
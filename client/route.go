@@ -0,0 +1,127 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/samalba/skyproxy/utils"
+)
+
+// Route forwards the requests matching a Host and a path prefix to a receiver
+type Route struct {
+	// Host is matched against the Host header, it can be a wildcard
+	// ("*.domain.tld"). An empty Host matches any host.
+	Host string
+	// PathPrefix is matched against the request path on a "/" boundary, an
+	// empty prefix matches any path
+	PathPrefix string
+	// Receiver is the address of the local receiver (ex: localhost:8080)
+	Receiver string
+}
+
+func (r Route) String() string {
+	return fmt.Sprintf("%s%s=%s", r.Host, r.PathPrefix, r.Receiver)
+}
+
+// ParseRoute parses a route formatted as "[host][/path/prefix]=receiver", for
+// instance "/api=localhost:8080", "api.domain.tld=localhost:8081" or
+// "www.domain.tld/static=localhost:8082"
+func ParseRoute(value string) (Route, error) {
+	idx := strings.LastIndex(value, "=")
+	if idx <= 0 || idx == len(value)-1 {
+		return Route{}, fmt.Errorf("Invalid route %q, expected [host][/path]=receiver", value)
+	}
+	route := Route{Receiver: strings.TrimSpace(value[idx+1:])}
+	match := strings.TrimSpace(value[:idx])
+	if slash := strings.Index(match, "/"); slash >= 0 {
+		route.Host = match[:slash]
+		route.PathPrefix = match[slash:]
+	} else {
+		route.Host = match
+	}
+	route.PathPrefix = strings.TrimRight(route.PathPrefix, "/")
+	return route, nil
+}
+
+// LoadRouteFile reads a file containing one route per line (see ParseRoute).
+// Empty lines and lines starting with "#" are ignored.
+func LoadRouteFile(path string) ([]Route, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	routes := []Route{}
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		route, err := ParseRoute(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, lineNum, err)
+		}
+		routes = append(routes, route)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return routes, nil
+}
+
+// hostRank tells how specifically the route Host matches a normalized host:
+// 0 when the route has no Host, then the higher the more specific (an exact
+// match, then the wildcards of the closest parent domains). It returns -1 if
+// the route does not match the host.
+func (r Route) hostRank(host string) int {
+	if r.Host == "" {
+		return 0
+	}
+	routeHost := utils.NormalizeHost(r.Host)
+	patterns := utils.HostPatterns(host)
+	for i, pattern := range patterns {
+		if pattern == routeHost {
+			return len(patterns) - i
+		}
+	}
+	return -1
+}
+
+// matchesPath tells whether the route applies to a request path
+func (r Route) matchesPath(path string) bool {
+	if r.PathPrefix == "" || path == r.PathPrefix {
+		return true
+	}
+	return strings.HasPrefix(path, r.PathPrefix+"/")
+}
+
+// findReceiver returns the receiver of the most specific route matching the
+// request: the route with the most specific Host wins ("*.domain.tld" matches
+// its sub-domains like on the server), then the longest path prefix wins. It
+// returns false if no route matches.
+func findReceiver(routes []Route, host, path string) (string, bool) {
+	host = utils.NormalizeHost(host)
+	var best *Route
+	bestRank := -1
+	for i := range routes {
+		route := &routes[i]
+		rank := route.hostRank(host)
+		if rank < 0 || !route.matchesPath(path) {
+			continue
+		}
+		if best == nil || rank > bestRank ||
+			(rank == bestRank && len(route.PathPrefix) > len(best.PathPrefix)) {
+			best = route
+			bestRank = rank
+		}
+	}
+	if best == nil {
+		return "", false
+	}
+	return best.Receiver, true
+}
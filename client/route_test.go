@@ -0,0 +1,38 @@
+package client
+
+import "testing"
+
+func TestFindReceiver(t *testing.T) {
+	routes := []Route{
+		{Receiver: "default"},
+		{PathPrefix: "/api", Receiver: "api"},
+		{Host: "*.preview.example.com", Receiver: "preview"},
+		{Host: "a.preview.example.com", Receiver: "a"},
+		{Host: "*.example.com", PathPrefix: "/static", Receiver: "static"},
+		{Host: "WWW.Example.com", Receiver: "www"},
+	}
+	tests := []struct {
+		host, path string
+		receiver   string
+	}{
+		{"other.org", "/", "default"},
+		{"other.org", "/api/users", "api"},
+		{"other.org", "/apis", "default"},
+		{"b.preview.example.com", "/", "preview"},
+		{"b.preview.example.com:8080", "/api", "preview"},
+		{"a.preview.example.com", "/", "a"},
+		{"b.preview.example.com", "/static/app.js", "preview"},
+		{"cdn.example.com", "/static/app.js", "static"},
+		{"cdn.example.com", "/", "default"},
+		{"www.example.com.", "/static", "www"},
+	}
+	for _, test := range tests {
+		receiver, found := findReceiver(routes, test.host, test.path)
+		if !found || receiver != test.receiver {
+			t.Errorf("findReceiver(%q, %q): expected %q, got %q", test.host, test.path, test.receiver, receiver)
+		}
+	}
+	if _, found := findReceiver(routes[2:], "other.org", "/"); found {
+		t.Error("Expected no receiver for a host matching no route")
+	}
+}
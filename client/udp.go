@@ -0,0 +1,85 @@
+package client
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/samalba/skyproxy/logging"
+	"github.com/samalba/skyproxy/utils"
+)
+
+// DefaultUDPIdleTimeout is the time after which a UDP flow without traffic is
+// closed when Client.UDPIdleTimeout is not set
+const DefaultUDPIdleTimeout = 60 * time.Second
+
+func (c *Client) udpIdleTimeout() time.Duration {
+	if c.UDPIdleTimeout > 0 {
+		return c.UDPIdleTimeout
+	}
+	return DefaultUDPIdleTimeout
+}
+
+// forwardUDP replays the datagrams of a UDP flow to the receiver and sends
+// its replies back, until the flow is idle or closed by the server
+func (c *Client) forwardUDP(log logging.Logger, stream *yamux.Stream, address string) {
+	buf := make([]byte, utils.MaxDatagramSize)
+	// The first frame is the source address of the flow
+	n, err := utils.ReadDatagram(stream, buf)
+	if err != nil {
+		log.Warn("Cannot read the UDP flow source", "error", err)
+		stream.Close()
+		return
+	}
+	log = log.With("remote_addr", string(buf[:n]))
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		log.Error("Cannot connect to receiver", "receiver", address, "error", err)
+		stream.Close()
+		return
+	}
+	idleTimeout := c.udpIdleTimeout()
+	timer := time.AfterFunc(idleTimeout, func() {
+		conn.Close()
+		stream.Close()
+	})
+	start := time.Now()
+	c.stats.streamStarted()
+	var bytesIn, bytesOut int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reply := make([]byte, utils.MaxDatagramSize)
+		for {
+			n, err := conn.Read(reply)
+			if err != nil {
+				break
+			}
+			timer.Reset(idleTimeout)
+			if err := utils.WriteDatagram(stream, reply[:n]); err != nil {
+				break
+			}
+			atomic.AddInt64(&bytesOut, int64(n))
+		}
+		stream.Close()
+	}()
+	for {
+		n, err := utils.ReadDatagram(stream, buf)
+		if err != nil {
+			break
+		}
+		timer.Reset(idleTimeout)
+		if _, err := conn.Write(buf[:n]); err != nil {
+			log.Debug("Cannot write to receiver", "receiver", address, "error", err)
+		}
+		atomic.AddInt64(&bytesIn, int64(n))
+	}
+	timer.Stop()
+	conn.Close()
+	stream.Close()
+	<-done
+	c.stats.streamDone(bytesIn, bytesOut)
+	log.Debug("UDP flow closed", "receiver", address, "bytes_in", bytesIn, "bytes", bytesOut,
+		"duration", time.Since(start))
+}
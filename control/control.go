@@ -0,0 +1,276 @@
+// Package control implements the messages exchanged by the Skyproxy server
+// and client on the control stream of a session.
+//
+// The control stream is the first stream opened by the client after the
+// registration. Each message is a JSON object on its own line, made of an
+// envelope (Message) and a typed payload. Both sides start by sending a
+// Hello message, a message with a Version higher than the one supported is
+// answered with an Error message.
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Version is the version of the control protocol
+const Version = 1
+
+// Message types
+const (
+	// TypeHello is the first message sent by both sides (Hello)
+	TypeHello = "hello"
+	// TypeStatus reports the readiness of the client receivers (Status)
+	TypeStatus = "status"
+	// TypeDrain announces that the sender stops accepting new streams and
+	// will close the session once the in-flight streams are done (Drain). The
+	// server replies with a TypeDrain message once the client is drained.
+	TypeDrain = "drain"
+	// TypeReconfigure changes the settings of the client (Reconfigure)
+	TypeReconfigure = "reconfigure"
+	// TypeStatsRequest asks the client for its statistics, the reply is a
+	// TypeStats message (no payload)
+	TypeStatsRequest = "stats_request"
+	// TypeStats are the statistics of the client (Stats)
+	TypeStats = "stats"
+	// TypeError is sent in reply to a message which cannot be handled (Error)
+	TypeError = "error"
+)
+
+var (
+	// ErrClosed is returned when the control stream is closed
+	ErrClosed = errors.New("Control stream closed")
+	// ErrTimeout is returned when no reply is received in time
+	ErrTimeout = errors.New("Control request timeout")
+)
+
+// Message is the envelope of all the messages
+type Message struct {
+	Version int    `json:"version"`
+	Type    string `json:"type"`
+	// ID identifies a message, ReplyTo is set to the ID of the request in a
+	// reply
+	ID      uint64          `json:"id"`
+	ReplyTo uint64          `json:"reply_to,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Decode decodes the payload of the message
+func (m *Message) Decode(v interface{}) error {
+	if len(m.Payload) == 0 {
+		return fmt.Errorf("Empty payload for control message %s", m.Type)
+	}
+	return json.Unmarshal(m.Payload, v)
+}
+
+// Hello starts the conversation
+type Hello struct {
+	// SkyproxyVersion is the version of the sender
+	SkyproxyVersion string `json:"skyproxy_version"`
+}
+
+// Status reports the readiness of the client receivers
+type Status struct {
+	Ready bool `json:"ready"`
+	// Reason explains why the receivers are not ready
+	Reason string `json:"reason,omitempty"`
+}
+
+// Drain announces that the sender stops accepting new streams
+type Drain struct {
+	Reason string `json:"reason,omitempty"`
+	// Timeout is the maximum time, in seconds, before the session is closed
+	Timeout int `json:"timeout,omitempty"`
+}
+
+// Reconfigure changes the settings of the client, the zero values are
+// ignored
+type Reconfigure struct {
+	// ReceiverCheckInterval is the interval between two checks of the
+	// receivers, in milliseconds
+	ReceiverCheckInterval int `json:"receiver_check_interval,omitempty"`
+}
+
+// Stats are the statistics of the client
+type Stats struct {
+	ActiveStreams int64  `json:"active_streams"`
+	TotalStreams  uint64 `json:"total_streams"`
+	BytesIn       uint64 `json:"bytes_in"`
+	BytesOut      uint64 `json:"bytes_out"`
+	Ready         bool   `json:"ready"`
+	Draining      bool   `json:"draining"`
+}
+
+// Error is sent in reply to a message which cannot be handled
+type Error struct {
+	Message string `json:"message"`
+}
+
+// Conn sends and receives the messages on a control stream. It is safe for
+// concurrent use.
+type Conn struct {
+	rw        io.ReadWriteCloser
+	decoder   *json.Decoder
+	encoder   *json.Encoder
+	writeLock sync.Mutex
+	lock      sync.Mutex
+	nextID    uint64
+	pending   map[uint64]chan *Message
+	closed    bool
+}
+
+// NewConn creates a Conn on a stream
+func NewConn(rw io.ReadWriteCloser) *Conn {
+	return &Conn{
+		rw:      rw,
+		decoder: json.NewDecoder(rw),
+		encoder: json.NewEncoder(rw),
+		pending: make(map[uint64]chan *Message),
+	}
+}
+
+// send writes a message, the reply is delivered to ch when it is not nil
+func (c *Conn) send(msgType string, replyTo uint64, payload interface{}, ch chan *Message) (uint64, error) {
+	msg := &Message{Version: Version, Type: msgType, ReplyTo: replyTo}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return 0, err
+		}
+		msg.Payload = data
+	}
+	// The IDs are assigned in the write order
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return 0, ErrClosed
+	}
+	c.nextID++
+	msg.ID = c.nextID
+	if ch != nil {
+		c.pending[msg.ID] = ch
+	}
+	c.lock.Unlock()
+	return msg.ID, c.encoder.Encode(msg)
+}
+
+// Send sends a message, payload can be nil
+func (c *Conn) Send(msgType string, payload interface{}) error {
+	_, err := c.send(msgType, 0, payload, nil)
+	return err
+}
+
+// Reply sends a message in reply to another one
+func (c *Conn) Reply(to *Message, msgType string, payload interface{}) error {
+	_, err := c.send(msgType, to.ID, payload, nil)
+	return err
+}
+
+// Request sends a message and waits for the reply, Serve must be running to
+// receive it
+func (c *Conn) Request(msgType string, payload interface{}, timeout time.Duration) (*Message, error) {
+	ch := make(chan *Message, 1)
+	id, err := c.send(msgType, 0, payload, ch)
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case reply, ok := <-ch:
+		if !ok {
+			return nil, ErrClosed
+		}
+		if reply.Type == TypeError {
+			var e Error
+			reply.Decode(&e)
+			return nil, fmt.Errorf("Control request %s failed: %s", msgType, e.Message)
+		}
+		return reply, nil
+	case <-time.After(timeout):
+		return nil, ErrTimeout
+	}
+}
+
+// Receive reads the next message. A message with an unsupported version is
+// answered with an Error and skipped, the stream stays open so that a newer
+// peer can fall back to this version. A reply with an unsupported version is
+// returned as an Error reply to fail the pending request.
+func (c *Conn) Receive() (*Message, error) {
+	for {
+		msg := &Message{}
+		if err := c.decoder.Decode(msg); err != nil {
+			return nil, err
+		}
+		if msg.Version >= 1 && msg.Version <= Version {
+			return msg, nil
+		}
+		e := &Error{Message: fmt.Sprintf("Unsupported control protocol version %d, expected %d", msg.Version, Version)}
+		if msg.ReplyTo != 0 {
+			payload, _ := json.Marshal(e)
+			return &Message{Version: Version, Type: TypeError, ID: msg.ID, ReplyTo: msg.ReplyTo, Payload: payload}, nil
+		}
+		if msg.Type == TypeError {
+			// Never answer an Error with another one
+			continue
+		}
+		if err := c.Reply(msg, TypeError, e); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Serve reads the messages until the stream is closed. The replies to Request
+// are delivered to the caller, the other messages are passed to the handler.
+// The unknown message types should be answered with Error by the handler.
+func (c *Conn) Serve(handler func(*Message)) error {
+	defer c.Close()
+	for {
+		msg, err := c.Receive()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if msg.ReplyTo != 0 {
+			c.lock.Lock()
+			ch, exists := c.pending[msg.ReplyTo]
+			if exists {
+				// Buffered channel, a single reply is delivered
+				delete(c.pending, msg.ReplyTo)
+				ch <- msg
+			}
+			c.lock.Unlock()
+			if exists {
+				continue
+			}
+		}
+		handler(msg)
+	}
+}
+
+// Close closes the stream, the pending requests fail with ErrClosed
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		return nil
+	}
+	c.closed = true
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+	c.lock.Unlock()
+	return c.rw.Close()
+}
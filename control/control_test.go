@@ -0,0 +1,67 @@
+package control
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+// rawPeer writes and reads the raw messages on the other side of a Conn
+type rawPeer struct {
+	conn    net.Conn
+	encoder *json.Encoder
+	decoder *json.Decoder
+}
+
+func newTestConn() (*Conn, *rawPeer) {
+	a, b := net.Pipe()
+	return NewConn(a), &rawPeer{conn: b, encoder: json.NewEncoder(b), decoder: json.NewDecoder(b)}
+}
+
+func TestReceiveUnsupportedVersion(t *testing.T) {
+	c, peer := newTestConn()
+	defer c.Close()
+	received := make(chan *Message, 1)
+	go func() {
+		msg, err := c.Receive()
+		if err != nil {
+			t.Error(err)
+		}
+		received <- msg
+	}()
+	peer.encoder.Encode(&Message{Version: Version + 1, Type: "future", ID: 1})
+	var reply Message
+	if err := peer.decoder.Decode(&reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Type != TypeError || reply.ReplyTo != 1 {
+		t.Fatalf("Expected an error reply to message 1, got %s in reply to %d", reply.Type, reply.ReplyTo)
+	}
+	// The stream is still open
+	peer.encoder.Encode(&Message{Version: Version, Type: TypeStatus, ID: 2, Payload: json.RawMessage(`{"ready":true}`)})
+	select {
+	case msg := <-received:
+		if msg.Type != TypeStatus || msg.ID != 2 {
+			t.Fatalf("Expected the status message 2, got %s %d", msg.Type, msg.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("The message following the unsupported one was not received")
+	}
+}
+
+func TestRequestUnsupportedReplyVersion(t *testing.T) {
+	c, peer := newTestConn()
+	defer c.Close()
+	go c.Serve(func(*Message) {})
+	go func() {
+		var req Message
+		if err := peer.decoder.Decode(&req); err != nil {
+			return
+		}
+		peer.encoder.Encode(&Message{Version: Version + 1, Type: TypeStats, ID: 1, ReplyTo: req.ID})
+	}()
+	if _, err := c.Request(TypeStatsRequest, nil, time.Second); err == nil || err == ErrTimeout {
+		t.Fatalf("Expected the request to fail with an error reply, got %v", err)
+	}
+}
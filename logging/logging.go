@@ -0,0 +1,204 @@
+// Package logging implements the leveled and structured logger used by the
+// Skyproxy server and client.
+//
+// Each line is made of a time, a level, a message and a list of fields given
+// as key/value pairs. The lines are written in the logfmt or the JSON format.
+// Durations are written in seconds and errors as their message.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log line
+type Level int
+
+// Levels, from the most to the least verbose
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the Level of a name (debug, info, warn or error)
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.ToLower(name) == levelName {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// Output formats
+const (
+	FormatLogfmt = "logfmt"
+	FormatJSON   = "json"
+)
+
+// Logger writes structured log lines, the fields are key/value pairs
+type Logger interface {
+	Debug(msg string, fields ...interface{})
+	Info(msg string, fields ...interface{})
+	Warn(msg string, fields ...interface{})
+	Error(msg string, fields ...interface{})
+	// With returns a Logger adding the fields to each line
+	With(fields ...interface{}) Logger
+}
+
+// output is shared by a logger and the loggers created by With
+type output struct {
+	lock  sync.Mutex
+	w     io.Writer
+	json  bool
+	level Level
+	now   func() time.Time
+}
+
+type logger struct {
+	out    *output
+	fields []interface{}
+}
+
+// New creates a Logger writing the lines of level or above to w, in the
+// logfmt or JSON format
+func New(w io.Writer, format string, level Level) (Logger, error) {
+	switch format {
+	case FormatLogfmt, "":
+	case FormatJSON:
+	default:
+		return nil, fmt.Errorf("Unknown log format %q, expected %s or %s", format, FormatLogfmt, FormatJSON)
+	}
+	return &logger{out: &output{w: w, json: format == FormatJSON, level: level, now: time.Now}}, nil
+}
+
+var defaultLogger = &logger{out: &output{w: os.Stderr, level: LevelInfo, now: time.Now}}
+
+// Default returns the Logger used when none is set: info level, logfmt on
+// stderr
+func Default() Logger {
+	return defaultLogger
+}
+
+func (l *logger) Debug(msg string, fields ...interface{}) { l.log(LevelDebug, msg, fields) }
+func (l *logger) Info(msg string, fields ...interface{})  { l.log(LevelInfo, msg, fields) }
+func (l *logger) Warn(msg string, fields ...interface{})  { l.log(LevelWarn, msg, fields) }
+func (l *logger) Error(msg string, fields ...interface{}) { l.log(LevelError, msg, fields) }
+
+func (l *logger) With(fields ...interface{}) Logger {
+	all := make([]interface{}, 0, len(l.fields)+len(fields))
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+	return &logger{out: l.out, fields: all}
+}
+
+func (l *logger) log(level Level, msg string, fields []interface{}) {
+	if level < l.out.level {
+		return
+	}
+	all := make([]interface{}, 0, 6+len(l.fields)+len(fields))
+	all = append(all, "time", l.out.now().UTC().Format(time.RFC3339Nano), "level", level.String(), "msg", msg)
+	all = append(all, l.fields...)
+	all = append(all, fields...)
+	buf := &bytes.Buffer{}
+	if l.out.json {
+		writeJSON(buf, all)
+	} else {
+		writeLogfmt(buf, all)
+	}
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+// fieldValue converts the values which have a special representation
+func fieldValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case time.Duration:
+		return value.Seconds()
+	case error:
+		return value.Error()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return v
+}
+
+// pairs calls fn for each key/value pair, a missing value is written as
+// "MISSING"
+func pairs(fields []interface{}, fn func(key string, value interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		key := fmt.Sprint(fields[i])
+		var value interface{} = "MISSING"
+		if i+1 < len(fields) {
+			value = fieldValue(fields[i+1])
+		}
+		fn(key, value)
+	}
+}
+
+func writeLogfmt(buf *bytes.Buffer, fields []interface{}) {
+	first := true
+	pairs(fields, func(key string, value interface{}) {
+		if !first {
+			buf.WriteByte(' ')
+		}
+		first = false
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		var s string
+		switch v := value.(type) {
+		case string:
+			s = v
+		case float64:
+			s = strconv.FormatFloat(v, 'f', -1, 64)
+		case []string:
+			s = strings.Join(v, ",")
+		default:
+			s = fmt.Sprint(v)
+		}
+		if s == "" || strings.ContainsAny(s, " =\"\t\r\n\\") {
+			s = strconv.Quote(s)
+		}
+		buf.WriteString(s)
+	})
+	buf.WriteByte('\n')
+}
+
+func writeJSON(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	first := true
+	pairs(fields, func(key string, value interface{}) {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		k, _ := json.Marshal(key)
+		buf.Write(k)
+		buf.WriteByte(':')
+		v, err := json.Marshal(value)
+		if err != nil {
+			v, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(v)
+	})
+	buf.WriteString("}\n")
+}
@@ -0,0 +1,309 @@
+// Package metrics exports counters, gauges and histograms in the Prometheus
+// text format.
+//
+// Each metric has a fixed list of label names, the values are given on each
+// update. Collect hooks are run before each export to update the metrics
+// which are computed from the current state (for instance the number of
+// connected clients).
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the upper bounds of the histogram buckets, in seconds
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metric is implemented by Counter, Gauge, Histogram and the func metrics
+type metric interface {
+	write(w io.Writer)
+}
+
+// Registry holds the metrics exported by a Handler
+type Registry struct {
+	lock     sync.Mutex
+	metrics  []metric
+	collects []func()
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// OnCollect adds a hook run before each export
+func (r *Registry) OnCollect(fn func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.collects = append(r.collects, fn)
+}
+
+// WriteTo writes all the metrics in the Prometheus text format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.lock.Lock()
+	collects := r.collects
+	metrics := r.metrics
+	r.lock.Unlock()
+	for _, fn := range collects {
+		fn()
+	}
+	buf := &bytes.Buffer{}
+	for _, m := range metrics {
+		m.write(buf)
+	}
+	return buf.WriteTo(w)
+}
+
+// Handler returns an HTTP handler exporting the metrics
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// desc is the description shared by all the metric types
+type desc struct {
+	name   string
+	help   string
+	labels []string
+}
+
+func (d *desc) writeHeader(w io.Writer, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, d.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, kind)
+}
+
+// key joins the label values, it panics if their number does not match the
+// label names
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labelPairs formats the labels of a serie, extra is appended as is
+func (d *desc) labelPairs(key string, extra string) string {
+	pairs := []string{}
+	if len(d.labels) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, d.labels[i]+"="+strconv.Quote(value))
+		}
+	}
+	if extra != "" {
+		pairs = append(pairs, extra)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// values stores a float per label values
+type values struct {
+	desc
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func (v *values) add(delta float64, labelValues []string) {
+	key := v.key(labelValues)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.values[key] += delta
+}
+
+func (v *values) write(w io.Writer, kind string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.writeHeader(w, kind)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labelPairs(key, ""), formatValue(v.values[key]))
+	}
+}
+
+// Counter is a value which only goes up
+type Counter struct {
+	values
+}
+
+// NewCounter creates and registers a Counter
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{values{desc: desc{name, help, labels}, values: make(map[string]float64)}}
+	r.register(c)
+	return c
+}
+
+// Inc adds 1 to the Counter
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+// Add adds a positive value to the Counter
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+	c.add(delta, labelValues)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.values.write(w, "counter")
+}
+
+// Gauge is a value which can go up and down
+type Gauge struct {
+	values
+}
+
+// NewGauge creates and registers a Gauge
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{values{desc: desc{name, help, labels}, values: make(map[string]float64)}}
+	r.register(g)
+	return g
+}
+
+// Set sets the value of the Gauge
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values.values[key] = value
+}
+
+// Add adds a value, possibly negative, to the Gauge
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.add(delta, labelValues)
+}
+
+// Reset removes all the label values of the Gauge, it is used by the collect
+// hooks before setting the current values
+func (g *Gauge) Reset() {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values.values = make(map[string]float64)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.values.write(w, "gauge")
+}
+
+// funcMetric is an unlabeled metric whose value is read on each export
+type funcMetric struct {
+	desc
+	kind string
+	fn   func() float64
+}
+
+// NewCounterFunc registers a counter whose value is returned by fn, fn must
+// return a value which only goes up
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{desc{name, help, nil}, "counter", fn})
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by fn
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64) {
+	r.register(&funcMetric{desc{name, help, nil}, "gauge", fn})
+}
+
+func (m *funcMetric) write(w io.Writer) {
+	m.writeHeader(w, m.kind)
+	fmt.Fprintf(w, "%s %s\n", m.name, formatValue(m.fn()))
+}
+
+// histogramSerie is the state of a Histogram for some label values
+type histogramSerie struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts the observed values in buckets
+type Histogram struct {
+	desc
+	buckets []float64
+	lock    sync.Mutex
+	series  map[string]*histogramSerie
+}
+
+// NewHistogram creates and registers a Histogram, the buckets are the sorted
+// upper bounds of the buckets (DefaultBuckets if nil)
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{
+		desc:    desc{name, help, labels},
+		buckets: buckets,
+		series:  make(map[string]*histogramSerie),
+	}
+	r.register(h)
+	return h
+}
+
+// Observe adds a value to the Histogram
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	key := h.key(labelValues)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	serie, exists := h.series[key]
+	if !exists {
+		serie = &histogramSerie{counts: make([]uint64, len(h.buckets))}
+		h.series[key] = serie
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			serie.counts[i]++
+		}
+	}
+	serie.count++
+	serie.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.writeHeader(w, "histogram")
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		serie := h.series[key]
+		for i, bound := range h.buckets {
+			le := "le=" + strconv.Quote(formatValue(bound))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, le), serie.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelPairs(key, `le="+Inf"`), serie.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelPairs(key, ""), formatValue(serie.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelPairs(key, ""), serie.count)
+	}
+}
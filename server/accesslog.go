@@ -0,0 +1,211 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Access log formats, any other format is parsed as a text/template executed
+// with an AccessLogEntry
+const (
+	AccessLogCombined = "combined"
+	AccessLogJSON     = "json"
+)
+
+// AccessLogEntry describes a public request
+type AccessLogEntry struct {
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"remote_addr"`
+	Host       string        `json:"host"`
+	Method     string        `json:"method"`
+	URI        string        `json:"uri"`
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Referer    string        `json:"referer"`
+	UserAgent  string        `json:"user_agent"`
+	Duration   time.Duration `json:"-"`
+	// ClientID is the Client which served the request, it is empty if the
+	// request was not proxied
+	ClientID string `json:"client_id"`
+}
+
+// Seconds returns the duration of the request in seconds
+func (e *AccessLogEntry) Seconds() float64 {
+	return e.Duration.Seconds()
+}
+
+// AccessLog writes an entry per public request to a file or to stdout
+type AccessLog struct {
+	lock     sync.Mutex
+	path     string
+	w        io.Writer
+	file     *os.File
+	format   string
+	template *template.Template
+}
+
+// NewAccessLog opens an access log, path is a file opened in append mode or
+// "-" for stdout. The format is AccessLogCombined, AccessLogJSON or a
+// text/template.
+func NewAccessLog(path, format string) (*AccessLog, error) {
+	a := &AccessLog{path: path, format: format}
+	switch format {
+	case AccessLogCombined, AccessLogJSON:
+	default:
+		tmpl, err := template.New("access").Parse(format)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid access log template: %s", err)
+		}
+		a.template = tmpl
+	}
+	if err := a.Reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Reopen closes and opens again the file of the access log, it is called
+// after the file has been rotated
+func (a *AccessLog) Reopen() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.path == "-" {
+		a.w = os.Stdout
+		return nil
+	}
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Cannot open the access log: %s", err)
+	}
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = file
+	a.w = file
+	return nil
+}
+
+// Close closes the file of the access log
+func (a *AccessLog) Close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.file == nil {
+		return nil
+	}
+	err := a.file.Close()
+	a.file = nil
+	a.w = ioutil.Discard
+	return err
+}
+
+// Log writes an entry
+func (a *AccessLog) Log(entry *AccessLogEntry) {
+	buf := &bytes.Buffer{}
+	switch a.format {
+	case AccessLogCombined:
+		writeCombined(buf, entry)
+	case AccessLogJSON:
+		// The duration is written in seconds
+		json.NewEncoder(buf).Encode(struct {
+			*AccessLogEntry
+			Duration float64 `json:"duration"`
+		}{entry, entry.Seconds()})
+	default:
+		a.template.Execute(buf, entry)
+		if buf.Len() == 0 || buf.Bytes()[buf.Len()-1] != '\n' {
+			buf.WriteByte('\n')
+		}
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.w.Write(buf.Bytes())
+}
+
+// writeCombined writes an entry in the Combined Log Format
+func writeCombined(buf *bytes.Buffer, e *AccessLogEntry) {
+	host := e.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	size := "-"
+	if e.Bytes > 0 {
+		size = fmt.Sprint(e.Bytes)
+	}
+	fmt.Fprintf(buf, "%s - - [%s] \"%s %s %s\" %d %s \"%s\" \"%s\"\n",
+		host, e.Time.Format("02/Jan/2006:15:04:05 -0700"), e.Method, escapeQuotes(e.URI), e.Proto,
+		e.Status, size, escapeQuotes(e.Referer), escapeQuotes(e.UserAgent))
+}
+
+// escapeQuotes escapes a quoted field, an empty field is written as "-"
+func escapeQuotes(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, "\"", "\\\"", -1)
+}
+
+// responseRecorder counts the bytes of the response body written to the
+// visitor
+type responseRecorder struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.written += int64(n)
+	return n, err
+}
+
+// Hijack lets the upgraded connections take over the visitor connection, the
+// bytes written after the hijack are not counted
+func (r *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("Hijacking not supported")
+	}
+	return hj.Hijack()
+}
+
+func (r *responseRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// logAccess writes the access log entry of a public request
+func (s *Server) logAccess(r *http.Request, stream *countingConn, status int, written int64, start time.Time) {
+	if s.AccessLog == nil {
+		return
+	}
+	entry := &AccessLogEntry{
+		Time:       start,
+		RemoteAddr: r.RemoteAddr,
+		Host:       r.Host,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Status:     status,
+		Bytes:      written,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Duration:   time.Since(start),
+	}
+	if stream != nil {
+		entry.ClientID = stream.client.ID
+	}
+	s.AccessLog.Log(entry)
+}
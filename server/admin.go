@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// errMaintenance is returned when the host is in maintenance mode
+var errMaintenance = errors.New("Host in maintenance mode")
+
+// clientTraffic counts the bytes proxied through a Client, it is updated
+// atomically
+type clientTraffic struct {
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+// countingConn counts the bytes read from and written to a Client stream,
+// for the Client and for the stream itself
+type countingConn struct {
+	*yamux.Stream
+	client   *Client
+	bytesIn  uint64
+	bytesOut uint64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Stream.Read(b)
+	atomic.AddUint64(&c.client.traffic.bytesIn, uint64(n))
+	atomic.AddUint64(&c.bytesIn, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Stream.Write(b)
+	atomic.AddUint64(&c.client.traffic.bytesOut, uint64(n))
+	atomic.AddUint64(&c.bytesOut, uint64(n))
+	return n, err
+}
+
+// BytesIn returns the number of bytes received from the Client streams,
+// BytesOut the number of bytes sent to them
+func (c *Client) BytesIn() uint64 {
+	return atomic.LoadUint64(&c.traffic.bytesIn)
+}
+
+// BytesOut returns the number of bytes sent to the Client streams
+func (c *Client) BytesOut() uint64 {
+	return atomic.LoadUint64(&c.traffic.bytesOut)
+}
+
+// OpenStreams returns the number of streams open on the Client session, the
+// control stream excluded
+func (c *Client) OpenStreams() int {
+	n := c.Session.NumStreams()
+	if c.controlConn() != nil && n > 0 {
+		n--
+	}
+	return n
+}
+
+// SetMaintenance enables or disables the maintenance mode of a host, the
+// requests for a host in maintenance get a 503 page
+func (s *Server) SetMaintenance(host string, enabled bool) {
+	host = registryKey(host)
+	s.maintenanceLock.Lock()
+	defer s.maintenanceLock.Unlock()
+	if enabled {
+		s.maintenance[host] = true
+	} else {
+		delete(s.maintenance, host)
+	}
+}
+
+// InMaintenance returns true if the host is in maintenance mode
+func (s *Server) InMaintenance(host string) bool {
+	s.maintenanceLock.Lock()
+	defer s.maintenanceLock.Unlock()
+	return s.maintenance[registryKey(host)]
+}
+
+// HostInfo is returned by the admin API for each registered host
+type HostInfo struct {
+	Host        string `json:"host"`
+	Clients     int    `json:"clients"`
+	Available   int    `json:"available"`
+	Maintenance bool   `json:"maintenance"`
+}
+
+// ClientInfo is returned by the admin API for each Client
+type ClientInfo struct {
+	ID          string    `json:"id"`
+	Hosts       []string  `json:"hosts"`
+	RemoteAddr  string    `json:"remote_address"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Version     string    `json:"version"`
+	Weight      int       `json:"weight"`
+	OpenStreams int       `json:"open_streams"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	Healthy     bool      `json:"healthy"`
+	Ready       bool      `json:"ready"`
+	Draining    bool      `json:"draining"`
+	RTT         float64   `json:"rtt_ms"`
+}
+
+func newClientInfo(client *Client) ClientInfo {
+	return ClientInfo{
+		ID:          client.ID,
+		Hosts:       client.HTTPHosts,
+		RemoteAddr:  client.Conn.RemoteAddr().String(),
+		ConnectedAt: client.ConnectedAt,
+		Version:     client.Version,
+		Weight:      client.weight(),
+		OpenStreams: client.OpenStreams(),
+		BytesIn:     client.BytesIn(),
+		BytesOut:    client.BytesOut(),
+		Healthy:     client.Healthy(),
+		Ready:       client.Ready(),
+		Draining:    client.Draining(),
+		RTT:         client.RTT().Seconds() * 1000,
+	}
+}
+
+// writeJSON replies to an admin request
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeJSONError replies to an admin request with an error message
+func writeJSONError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]string{"error": message})
+}
+
+// createAdminHTTPHandler returns the handler of the admin API:
+//
+//	GET    /hosts                     lists the registered hosts
+//	GET    /hosts/<host>/clients      lists the Clients of a host
+//	PUT    /hosts/<host>/maintenance  enables the maintenance mode of a host
+//	DELETE /hosts/<host>/maintenance  disables it
+//	GET    /clients                   lists all the Clients
+//	DELETE /clients/<id>              disconnects a Client
+func createAdminHTTPHandler(s *Server) func(http.ResponseWriter, *http.Request) {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "hosts":
+			s.adminListHosts(w, r)
+		case len(parts) == 3 && parts[0] == "hosts" && parts[2] == "clients":
+			s.adminListClients(w, r, parts[1])
+		case len(parts) == 3 && parts[0] == "hosts" && parts[2] == "maintenance":
+			s.adminMaintenance(w, r, parts[1])
+		case len(parts) == 1 && parts[0] == "clients":
+			s.adminListClients(w, r, "")
+		case len(parts) == 2 && parts[0] == "clients":
+			s.adminDisconnect(w, r, parts[1])
+		default:
+			writeJSONError(w, http.StatusNotFound, "Not found")
+		}
+	}
+	return h
+}
+
+func (s *Server) adminListHosts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	list := s.registry.List()
+	names := make([]string, 0, len(list))
+	for host := range list {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+	hosts := []HostInfo{}
+	for _, host := range names {
+		hosts = append(hosts, HostInfo{
+			Host:        host,
+			Clients:     len(list[host]),
+			Available:   len(availableClients(list[host])),
+			Maintenance: s.InMaintenance(host),
+		})
+	}
+	writeJSON(w, http.StatusOK, hosts)
+}
+
+// adminListClients lists the Clients registered for host, or all the Clients
+// if host is empty
+func (s *Server) adminListClients(w http.ResponseWriter, r *http.Request, host string) {
+	if r.Method != "GET" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	var clients []*Client
+	if host == "" {
+		clients = s.uniqueClients()
+	} else {
+		clients = s.registry.List()[registryKey(host)]
+		if clients == nil {
+			writeJSONError(w, http.StatusNotFound, "Host not registered")
+			return
+		}
+	}
+	infos := []ClientInfo{}
+	for _, client := range clients {
+		infos = append(infos, newClientInfo(client))
+	}
+	writeJSON(w, http.StatusOK, infos)
+}
+
+func (s *Server) adminMaintenance(w http.ResponseWriter, r *http.Request, host string) {
+	switch r.Method {
+	case "PUT":
+		s.SetMaintenance(host, true)
+		s.log.Info("Maintenance mode enabled", "host", host, "remote_addr", r.RemoteAddr)
+	case "DELETE":
+		s.SetMaintenance(host, false)
+		s.log.Info("Maintenance mode disabled", "host", host, "remote_addr", r.RemoteAddr)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"host":        registryKey(host),
+		"maintenance": s.InMaintenance(host),
+	})
+}
+
+func (s *Server) adminDisconnect(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != "DELETE" {
+		writeJSONError(w, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+	for _, client := range s.uniqueClients() {
+		if client.ID != id {
+			continue
+		}
+		if s.registry.Remove(client) {
+			client.Close()
+			client.log.Info("Client disconnected by the admin API", "admin_addr", r.RemoteAddr)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSONError(w, http.StatusNotFound, "Client not registered")
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Session affinity modes
+const (
+	// AffinityNone lets the Balancer pick a Client for each request
+	AffinityNone = ""
+	// AffinityCookie pins a visitor to a Client with a cookie set by the server
+	AffinityCookie = "cookie"
+	// AffinityIP pins a visitor to a Client from a hash of its IP address
+	AffinityIP = "ip"
+)
+
+// DefaultAffinityCookie is the name of the affinity cookie
+const DefaultAffinityCookie = "skyproxy_affinity"
+
+// ipAffinity picks the Clients for the ip affinity mode
+var ipAffinity = &hashBalancer{}
+
+// validAffinity checks an affinity mode
+func validAffinity(mode string) error {
+	switch mode {
+	case AffinityNone, AffinityCookie, AffinityIP:
+		return nil
+	}
+	return fmt.Errorf("Unknown affinity mode %q", mode)
+}
+
+// affinityKey is the value of the affinity cookie for a Client, it does not
+// disclose the session ID
+func (c *Client) affinityKey() string {
+	sum := sha1.Sum([]byte("affinity/" + c.ID))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (s *Server) affinityCookieName() string {
+	if s.AffinityCookie != "" {
+		return s.AffinityCookie
+	}
+	return DefaultAffinityCookie
+}
+
+// pickAffinityClient returns the Client a visitor is pinned to, or nil if the
+// visitor is not pinned or if its Client is not registered anymore
+func (s *Server) pickAffinityClient(clients []*Client, r *http.Request) *Client {
+	switch s.Affinity {
+	case AffinityIP:
+		return ipAffinity.Pick(clients, r)
+	case AffinityCookie:
+		cookie, err := r.Cookie(s.affinityCookieName())
+		if err != nil {
+			return nil
+		}
+		for _, client := range clients {
+			if client.affinityKey() == cookie.Value {
+				return client
+			}
+		}
+	}
+	return nil
+}
+
+// setAffinityCookie pins the visitor to the Client if needed
+func (s *Server) setAffinityCookie(w http.ResponseWriter, r *http.Request, client *Client) {
+	if s.Affinity != AffinityCookie {
+		return
+	}
+	key := client.affinityKey()
+	if cookie, err := r.Cookie(s.affinityCookieName()); err == nil && cookie.Value == key {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     s.affinityCookieName(),
+		Value:    key,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+	})
+}
+
+// removeCookie removes a cookie from the Cookie headers of a request, the
+// other cookies are kept as is
+func removeCookie(h http.Header, name string) {
+	values := h["Cookie"]
+	if len(values) == 0 {
+		return
+	}
+	h.Del("Cookie")
+	for _, value := range values {
+		kept := []string{}
+		for _, part := range strings.Split(value, ";") {
+			part = strings.TrimSpace(part)
+			if part == "" || strings.SplitN(part, "=", 2)[0] == name {
+				continue
+			}
+			kept = append(kept, part)
+		}
+		if len(kept) > 0 {
+			h.Add("Cookie", strings.Join(kept, "; "))
+		}
+	}
+}
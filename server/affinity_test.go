@@ -0,0 +1,26 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveCookie(t *testing.T) {
+	tests := []struct {
+		cookies  []string
+		expected []string
+	}{
+		{[]string{"skyproxy_affinity=abc"}, nil},
+		{[]string{"a=1; skyproxy_affinity=abc; b=2"}, []string{"a=1; b=2"}},
+		{[]string{"a=1", "skyproxy_affinity=abc"}, []string{"a=1"}},
+		{[]string{"skyproxy_affinity_other=1"}, []string{"skyproxy_affinity_other=1"}},
+	}
+	for _, test := range tests {
+		h := http.Header{"Cookie": test.cookies}
+		removeCookie(h, DefaultAffinityCookie)
+		if !reflect.DeepEqual(h["Cookie"], test.expected) {
+			t.Errorf("removeCookie(%q): expected %q, got %q", test.cookies, test.expected, h["Cookie"])
+		}
+	}
+}
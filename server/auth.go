@@ -0,0 +1,190 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var (
+	errMissingToken = errors.New("No registration token provided")
+	errInvalidToken = errors.New("Invalid registration token")
+	// errMissingClientCert is returned when a client certificate is required
+	// and the registration has none, for instance over plain HTTP
+	errMissingClientCert = errors.New("No verified client certificate provided")
+)
+
+// tokenEntry is a token (stored as a hash) with the host patterns it allows
+type tokenEntry struct {
+	hash     [sha256.Size]byte
+	patterns []string
+}
+
+// TokenStore holds the tokens allowed to register Clients
+type TokenStore struct {
+	tokens []tokenEntry
+}
+
+// readPatternFile reads a file where each line is a key followed by host
+// patterns, separated by spaces. Empty lines and lines starting with "#" are
+// ignored.
+func readPatternFile(path string, fn func(key string, patterns []string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	found := false
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("%s:%d: at least one host pattern is required", path, lineNum)
+		}
+		patterns := make([]string, 0, len(fields)-1)
+		for _, pattern := range fields[1:] {
+			patterns = append(patterns, strings.ToLower(pattern))
+		}
+		fn(fields[0], patterns)
+		found = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s: no entry found", path)
+	}
+	return nil
+}
+
+// LoadTokenFile reads the tokens from a file. Each line contains a token
+// followed by the host patterns it can register, separated by spaces. A
+// pattern is either a host name, "*.domain.tld" to allow any sub-domain, or
+// "*" to allow any host. Empty lines and lines starting with "#" are ignored.
+func LoadTokenFile(path string) (*TokenStore, error) {
+	store := &TokenStore{}
+	err := readPatternFile(path, func(token string, patterns []string) {
+		store.tokens = append(store.tokens, tokenEntry{
+			hash:     sha256.Sum256([]byte(token)),
+			patterns: patterns,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// CertAuthorizer authorizes the registrations of the Clients identified by a
+// TLS client certificate
+type CertAuthorizer struct {
+	identities map[string][]string
+}
+
+// LoadIdentityFile reads the host patterns allowed for each certificate
+// identity. The format is the same as the token file, with the certificate
+// Common Name or one of its DNS Subject Alternative Names instead of a token.
+func LoadIdentityFile(path string) (*CertAuthorizer, error) {
+	a := &CertAuthorizer{identities: make(map[string][]string)}
+	err := readPatternFile(path, func(identity string, patterns []string) {
+		identity = strings.ToLower(identity)
+		a.identities[identity] = append(a.identities[identity], patterns...)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// certIdentities returns the names identifying a certificate
+func certIdentities(cert *x509.Certificate) []string {
+	names := make([]string, 0, len(cert.DNSNames)+1)
+	if cert.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(cert.Subject.CommonName))
+	}
+	for _, name := range cert.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	return names
+}
+
+// Authorize checks that the certificate allows registering the host. Without
+// identity file (nil CertAuthorizer), the certificate names are used as host
+// patterns: a certificate for "*.dev.domain.tld" can register any of its
+// sub-domains.
+func (a *CertAuthorizer) Authorize(cert *x509.Certificate, host string) error {
+	host = registryKey(host)
+	for _, name := range certIdentities(cert) {
+		patterns := []string{name}
+		if a != nil {
+			patterns = a.identities[name]
+		}
+		for _, pattern := range patterns {
+			if matchHostPattern(pattern, host) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("Certificate %q not allowed to register the Host %s", cert.Subject.CommonName, host)
+}
+
+// matchHostPattern tells whether a host matches a pattern of the token file
+func matchHostPattern(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	if strings.HasSuffix(pattern, ":*") {
+		// "tcp:*" and "udp:*" match any TCP or UDP port
+		return strings.HasPrefix(host, pattern[:len(pattern)-1])
+	}
+	return pattern == host
+}
+
+// Authorize checks that the token exists and allows registering the host.
+// The token is compared against all the known tokens in constant time.
+func (t *TokenStore) Authorize(token, host string) error {
+	if token == "" {
+		return errMissingToken
+	}
+	hash := sha256.Sum256([]byte(token))
+	var found *tokenEntry
+	for i := range t.tokens {
+		if subtle.ConstantTimeCompare(hash[:], t.tokens[i].hash[:]) == 1 {
+			found = &t.tokens[i]
+		}
+	}
+	if found == nil {
+		return errInvalidToken
+	}
+	host = registryKey(host)
+	for _, pattern := range found.patterns {
+		if matchHostPattern(pattern, host) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Token not allowed to register the Host %s", host)
+}
+
+// bearerToken returns the token of the Authorization header
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "Bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
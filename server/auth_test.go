@@ -0,0 +1,100 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestMatchHostPattern(t *testing.T) {
+	tests := []struct {
+		pattern, host string
+		match         bool
+	}{
+		{"www.example.com", "www.example.com", true},
+		{"www.example.com", "api.example.com", false},
+		{"*.example.com", "api.example.com", true},
+		{"*.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", false},
+		{"*.example.com", "api.example.org", false},
+		{"*", "www.example.com", true},
+		{"*", "tcp:2222", true},
+		{"tcp:*", "tcp:2222", true},
+		{"tcp:*", "tcp:*", true},
+		{"tcp:2222", "tcp:2222", true},
+		{"tcp:2222", "tcp:2223", false},
+		{"tcp:*", "www.example.com", false},
+		{"*.example.com", "tcp:2222", false},
+		{"udp:*", "udp:21000", true},
+		{"udp:21000", "udp:21000", true},
+		{"udp:21000", "udp:21001", false},
+		{"udp:*", "tcp:2222", false},
+		{"tcp:*", "udp:21000", false},
+	}
+	for _, test := range tests {
+		if match := matchHostPattern(test.pattern, test.host); match != test.match {
+			t.Errorf("matchHostPattern(%q, %q): expected %v, got %v", test.pattern, test.host, test.match, match)
+		}
+	}
+}
+
+func TestTokenStoreAuthorize(t *testing.T) {
+	f, err := ioutil.TempFile("", "skyproxy-tokens")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("# Tokens\n" +
+		"web www.example.com *.Preview.example.com\n" +
+		"tcp tcp:*\n" +
+		"ssh tcp:2222\n" +
+		"udp udp:*\n" +
+		"dns udp:21000\n" +
+		"all *\n")
+	f.Close()
+	store, err := LoadTokenFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token, host string
+		err         bool
+	}{
+		{"web", "www.example.com", false},
+		{"web", "WWW.Example.com:8080", false},
+		{"web", "a.preview.example.com", false},
+		{"web", "preview.example.com", true},
+		{"web", "api.example.com", true},
+		{"web", "tcp:2222", true},
+		{"tcp", "tcp:2222", false},
+		{"tcp", "tcp:*", false},
+		{"tcp", "www.example.com", true},
+		{"ssh", "tcp:2222", false},
+		{"ssh", "tcp:*", true},
+		{"ssh", "tcp:2223", true},
+		{"udp", "udp:21000", false},
+		{"udp", "udp:*", false},
+		{"udp", "tcp:2222", true},
+		{"tcp", "udp:21000", true},
+		{"dns", "udp:21000", false},
+		{"dns", "udp:*", true},
+		{"dns", "udp:21001", true},
+		{"all", "tcp:2222", false},
+		{"all", "udp:21000", false},
+		{"all", "www.example.org", false},
+		{"unknown", "www.example.com", true},
+		{"", "www.example.com", true},
+	}
+	for _, test := range tests {
+		err := store.Authorize(test.token, test.host)
+		if (err != nil) != test.err {
+			t.Errorf("Authorize(%q, %q): expected an error %v, got %v", test.token, test.host, test.err, err)
+		}
+	}
+	if err := store.Authorize("", "www.example.com"); err != errMissingToken {
+		t.Errorf("Expected errMissingToken, got %v", err)
+	}
+	if err := store.Authorize("unknown", "www.example.com"); err != errInvalidToken {
+		t.Errorf("Expected errInvalidToken, got %v", err)
+	}
+}
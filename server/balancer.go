@@ -0,0 +1,150 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBalancer is the strategy used for the hosts without configuration
+const DefaultBalancer = "random"
+
+// Balancer picks the Client receiving a request among the Clients registered
+// for a host. The list of Clients is never empty. A Balancer is used by a
+// single host and must be safe for concurrent use.
+type Balancer interface {
+	Pick(clients []*Client, r *http.Request) *Client
+}
+
+// NewBalancer creates a Balancer from its name: "random", "round-robin",
+// "least-streams", "weighted", "hash-ip" or "hash-cookie:<cookie name>"
+func NewBalancer(name string) (Balancer, error) {
+	switch {
+	case name == "random":
+		return newRandomBalancer(), nil
+	case name == "round-robin":
+		return &roundRobinBalancer{}, nil
+	case name == "least-streams":
+		return &leastStreamsBalancer{}, nil
+	case name == "weighted":
+		return newWeightedBalancer(), nil
+	case name == "hash-ip":
+		return &hashBalancer{}, nil
+	case strings.HasPrefix(name, "hash-cookie:") && len(name) > len("hash-cookie:"):
+		return &hashBalancer{cookie: name[len("hash-cookie:"):]}, nil
+	}
+	return nil, fmt.Errorf("Unknown balancer %q", name)
+}
+
+// randomBalancer picks a Client randomly
+type randomBalancer struct {
+	random *rand.Rand
+	lock   sync.Mutex
+}
+
+func newRandomBalancer() *randomBalancer {
+	return &randomBalancer{random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (b *randomBalancer) intn(n int) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.random.Intn(n)
+}
+
+func (b *randomBalancer) Pick(clients []*Client, r *http.Request) *Client {
+	return clients[b.intn(len(clients))]
+}
+
+// roundRobinBalancer picks the Clients in turn
+type roundRobinBalancer struct {
+	next uint32
+}
+
+func (b *roundRobinBalancer) Pick(clients []*Client, r *http.Request) *Client {
+	n := atomic.AddUint32(&b.next, 1)
+	return clients[int(n-1)%len(clients)]
+}
+
+// leastStreamsBalancer picks the Client with the fewest open streams
+type leastStreamsBalancer struct{}
+
+func (b *leastStreamsBalancer) Pick(clients []*Client, r *http.Request) *Client {
+	best := clients[0]
+	bestStreams := best.Session.NumStreams()
+	for _, client := range clients[1:] {
+		if n := client.Session.NumStreams(); n < bestStreams {
+			best, bestStreams = client, n
+		}
+	}
+	return best
+}
+
+// weightedBalancer picks a Client randomly, proportionally to the weight it
+// advertised at registration
+type weightedBalancer struct {
+	randomBalancer
+}
+
+func newWeightedBalancer() *weightedBalancer {
+	return &weightedBalancer{*newRandomBalancer()}
+}
+
+func (b *weightedBalancer) Pick(clients []*Client, r *http.Request) *Client {
+	total := 0
+	for _, client := range clients {
+		total += client.weight()
+	}
+	n := b.intn(total)
+	for _, client := range clients {
+		if n -= client.weight(); n < 0 {
+			return client
+		}
+	}
+	return clients[len(clients)-1]
+}
+
+// hashBalancer picks a Client from a hash of a cookie or of the remote IP, a
+// visitor always reaches the same Client as long as it stays registered. It
+// uses rendezvous hashing so only the visitors of a disconnected Client are
+// moved to other Clients.
+type hashBalancer struct {
+	// cookie is the name of the cookie to hash, the remote IP is used when it
+	// is not set or when the request has no such cookie
+	cookie string
+}
+
+func (b *hashBalancer) key(r *http.Request) string {
+	if b.cookie != "" {
+		if cookie, err := r.Cookie(b.cookie); err == nil && cookie.Value != "" {
+			return cookie.Value
+		}
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return ip
+	}
+	return r.RemoteAddr
+}
+
+func (b *hashBalancer) Pick(clients []*Client, r *http.Request) *Client {
+	key := b.key(r)
+	var (
+		best      *Client
+		bestScore uint64
+	)
+	for _, client := range clients {
+		sum := sha1.Sum([]byte(client.ID + "/" + key))
+		score := binary.BigEndian.Uint64(sum[:8])
+		if best == nil || score > bestScore {
+			best, bestScore = client, score
+		}
+	}
+	return best
+}
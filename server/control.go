@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/samalba/skyproxy/control"
+	"github.com/samalba/skyproxy/utils"
+)
+
+// controlHelloTimeout is the time given to a Client to open its control
+// stream and say hello
+const controlHelloTimeout = 10 * time.Second
+
+// Ready returns false when the Client reported its receivers are not ready,
+// it is then excluded from the selection
+func (c *Client) Ready() bool {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	return !c.health.notReady
+}
+
+// setReady records the receivers status reported by the Client, it returns
+// true if the status changed
+func (c *Client) setReady(status control.Status) bool {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	changed := c.health.notReady == status.Ready
+	c.health.notReady = !status.Ready
+	c.health.notReadyReason = status.Reason
+	return changed
+}
+
+// controlConn returns the control stream of the Client, nil until the Client
+// said hello
+func (c *Client) controlConn() *control.Conn {
+	c.controlLock.Lock()
+	defer c.controlLock.Unlock()
+	return c.control
+}
+
+// SendControl sends a message to the Client on its control stream
+func (c *Client) SendControl(msgType string, payload interface{}) error {
+	ctrl := c.controlConn()
+	if ctrl == nil {
+		return fmt.Errorf("No control stream for this Client")
+	}
+	return ctrl.Send(msgType, payload)
+}
+
+// RequestStats asks the Client for its statistics
+func (c *Client) RequestStats(timeout time.Duration) (*control.Stats, error) {
+	ctrl := c.controlConn()
+	if ctrl == nil {
+		return nil, fmt.Errorf("No control stream for this Client")
+	}
+	reply, err := ctrl.Request(control.TypeStatsRequest, nil, timeout)
+	if err != nil {
+		return nil, err
+	}
+	stats := &control.Stats{}
+	if err := reply.Decode(stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// acceptClientStreams waits for the control stream of a Client, it is the
+// only stream a Client can open. The other streams are refused.
+func (s *Server) acceptClientStreams(client *Client) {
+	// The Client is closed if it does not open the control stream in time
+	helloTimer := time.AfterFunc(controlHelloTimeout, func() {
+		if client.controlConn() == nil {
+			client.log.Warn("No control stream opened by the client")
+			if s.registry.Remove(client) {
+				client.Close()
+			}
+		}
+	})
+	defer helloTimer.Stop()
+	for {
+		stream, err := client.Session.Accept()
+		if err != nil {
+			return
+		}
+		if client.controlConn() != nil {
+			client.log.Warn("Refusing a stream opened by the client")
+			stream.Close()
+			continue
+		}
+		ctrl := control.NewConn(stream)
+		msg, err := ctrl.Receive()
+		if err != nil || msg.Type != control.TypeHello {
+			client.log.Warn("Invalid control stream opened by the client", "error", err)
+			ctrl.Close()
+			continue
+		}
+		if err := ctrl.Reply(msg, control.TypeHello, &control.Hello{SkyproxyVersion: utils.Version}); err != nil {
+			ctrl.Close()
+			continue
+		}
+		client.controlLock.Lock()
+		client.control = ctrl
+		client.controlLock.Unlock()
+		helloTimer.Stop()
+		go ctrl.Serve(func(msg *control.Message) {
+			s.handleControl(client, ctrl, msg)
+		})
+	}
+}
+
+// handleControl handles the messages sent by a Client
+func (s *Server) handleControl(client *Client, ctrl *control.Conn, msg *control.Message) {
+	switch msg.Type {
+	case control.TypeStatus:
+		var status control.Status
+		if err := msg.Decode(&status); err != nil {
+			ctrl.Reply(msg, control.TypeError, &control.Error{Message: err.Error()})
+			return
+		}
+		if !client.setReady(status) {
+			return
+		}
+		if status.Ready {
+			client.log.Info("Client receivers ready")
+		} else {
+			client.log.Warn("Client receivers not ready", "reason", status.Reason)
+		}
+	case control.TypeDrain:
+		var drain control.Drain
+		msg.Decode(&drain)
+		if s.registry.Drain(client) {
+			client.log.Info("Client draining", "reason", drain.Reason)
+		}
+		// The Client waits for the acknowledgement before sending its GoAway
+		ctrl.Reply(msg, control.TypeDrain, &drain)
+	default:
+		ctrl.Reply(msg, control.TypeError, &control.Error{
+			Message: fmt.Sprintf("Unsupported message type %q", msg.Type),
+		})
+	}
+}
@@ -0,0 +1,432 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samalba/skyproxy/client"
+	"github.com/samalba/skyproxy/logging"
+	"github.com/samalba/skyproxy/utils"
+)
+
+// TestClientShutdownInFlight shuts a Client down (as on SIGUSR1) while
+// requests are in flight, they must all complete. The requests sent meanwhile
+// are either forwarded or refused, never failed by a dead session.
+func TestClientShutdownInFlight(t *testing.T) {
+	const inFlight = 20
+	logger, _ := logging.New(ioutil.Discard, logging.FormatLogfmt, logging.LevelError)
+	started := make(chan struct{}, inFlight)
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			started <- struct{}{}
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer receiver.Close()
+
+	s := NewServer()
+	s.SetLogger(logger)
+	clients := httptest.NewServer(http.HandlerFunc(createClientsHTTPHandler(s)))
+	defer clients.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(createPublicHTTPHandler(s)))
+	defer proxy.Close()
+
+	c := &client.Client{HTTPHosts: []string{"www.example.com"}, Logger: logger}
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- c.Run(strings.TrimPrefix(clients.URL, "http://"), nil, strings.TrimPrefix(receiver.URL, "http://"))
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Registry().Get("www.example.com")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The client did not register")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	get := func(path string) (int, string, error) {
+		req, _ := http.NewRequest("GET", proxy.URL+path, nil)
+		req.Host = "www.example.com"
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), err
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < inFlight; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			code, body, err := get("/slow")
+			if err != nil || code != http.StatusOK || body != "ok" {
+				t.Errorf("In-flight request failed: %d %q %v", code, body, err)
+			}
+		}()
+	}
+	for i := 0; i < inFlight; i++ {
+		<-started
+	}
+
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- c.Shutdown(5 * time.Second)
+	}()
+	// The requests sent during the shutdown
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			code, _, err := get("/")
+			if err != nil || (code != http.StatusOK && code != http.StatusServiceUnavailable) {
+				t.Errorf("Request failed during the shutdown: %d %v", code, err)
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+
+	select {
+	case err := <-shutdownDone:
+		if err != nil {
+			t.Errorf("Shutdown failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+	close(stop)
+	wg.Wait()
+	select {
+	case err := <-runDone:
+		if err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the shutdown")
+	}
+}
+
+// TestClientShutdownWhileConnecting shuts a Client down while its registration
+// is in progress, Run must return instead of serving the new session
+func TestClientShutdownWhileConnecting(t *testing.T) {
+	logger, _ := logging.New(ioutil.Discard, logging.FormatLogfmt, logging.LevelError)
+	s := NewServer()
+	s.SetLogger(logger)
+	clients := httptest.NewServer(http.HandlerFunc(createClientsHTTPHandler(s)))
+	defer clients.Close()
+	// The registration is held until the Client is shut down
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		close(accepted)
+		<-release
+		upstream, err := net.Dial("tcp", strings.TrimPrefix(clients.URL, "http://"))
+		if err != nil {
+			conn.Close()
+			return
+		}
+		utils.TunnelConn(conn, upstream, true)
+	}()
+
+	c := &client.Client{HTTPHosts: []string{"www.example.com"}, Logger: logger}
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- c.Run(l.Addr().String(), nil, "127.0.0.1:1")
+	}()
+	<-accepted
+	if err := c.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	select {
+	case err := <-runDone:
+		if err != nil {
+			t.Errorf("Run failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after the shutdown")
+	}
+}
+
+// freePort returns a TCP port which was free a moment ago
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// TestServerShutdownTCPTunnel shuts the server down while a TCP tunnel is
+// open, the port stops accepting connections and the tunnel completes
+func TestServerShutdownTCPTunnel(t *testing.T) {
+	logger, _ := logging.New(ioutil.Discard, logging.FormatLogfmt, logging.LevelError)
+	// The receiver echoes the first line once released, the connections of
+	// the receiver checks send nothing
+	receiver, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	go func() {
+		for {
+			conn, err := receiver.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err != nil {
+					return
+				}
+				started <- struct{}{}
+				<-release
+				conn.Write([]byte(line))
+			}()
+		}
+	}()
+
+	port := freePort(t)
+	s := NewServer()
+	s.SetLogger(logger)
+	s.TCPAddress = "127.0.0.1"
+	s.TCPPortMin, s.TCPPortMax = port, port
+	clients := httptest.NewServer(http.HandlerFunc(createClientsHTTPHandler(s)))
+	defer clients.Close()
+	c := &client.Client{Mode: utils.ModeTCP, TCPPort: port, Logger: logger}
+	go c.Run(strings.TrimPrefix(clients.URL, "http://"), nil, receiver.Addr().String())
+	defer c.Shutdown(time.Second)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Registry().Get(tcpHost(port))) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The client did not register")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+	<-started
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- s.Shutdown(5 * time.Second)
+	}()
+	for deadline = time.Now().Add(time.Second); ; {
+		other, err := net.Dial("tcp", address)
+		if err != nil {
+			break
+		}
+		other.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("The TCP port still accepts connections during the shutdown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(conn).ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("Expected the tunnel to complete, got %q %v", line, err)
+	}
+	conn.Close()
+	select {
+	case <-shutdownDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+// TestServerShutdownTLSTunnel shuts the server down while a TLS passthrough
+// tunnel is open, Shutdown waits for it to complete
+func TestServerShutdownTLSTunnel(t *testing.T) {
+	logger, _ := logging.New(ioutil.Discard, logging.FormatLogfmt, logging.LevelError)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	receiver := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer receiver.Close()
+	var releaseOnce sync.Once
+	releaseAll := func() { releaseOnce.Do(func() { close(release) }) }
+	defer releaseAll()
+
+	s := NewServer()
+	s.SetLogger(logger)
+	address := fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	go s.StartPassthroughServer(address)
+	clients := httptest.NewServer(http.HandlerFunc(createClientsHTTPHandler(s)))
+	defer clients.Close()
+	c := &client.Client{Mode: utils.ModeTLS, HTTPHosts: []string{"www.example.com"}, Logger: logger}
+	go c.Run(strings.TrimPrefix(clients.URL, "http://"), nil, strings.TrimPrefix(receiver.URL, "https://"))
+	defer c.Shutdown(time.Second)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Registry().Get(tlsHostPrefix+"www.example.com")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The client did not register")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	transport := &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, address)
+		},
+	}
+	defer transport.CloseIdleConnections()
+	type result struct {
+		body string
+		err  error
+	}
+	resultChan := make(chan result, 1)
+	go func() {
+		resp, err := (&http.Client{Transport: transport}).Get("https://www.example.com/")
+		if err != nil {
+			resultChan <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		resultChan <- result{string(body), err}
+	}()
+	<-started
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- s.Shutdown(5 * time.Second)
+	}()
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned before the tunnel completed")
+	case <-time.After(200 * time.Millisecond):
+	}
+	releaseAll()
+	if r := <-resultChan; r.err != nil || r.body != "ok" {
+		t.Fatalf("Expected the tunnel to complete, got %q %v", r.body, r.err)
+	}
+	transport.CloseIdleConnections()
+	select {
+	case <-shutdownDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
+
+// TestServerShutdownUpgradeTunnel shuts the server down while an upgraded
+// connection is open, Shutdown waits for it to complete
+func TestServerShutdownUpgradeTunnel(t *testing.T) {
+	logger, _ := logging.New(ioutil.Discard, logging.FormatLogfmt, logging.LevelError)
+	// The receiver switches protocols and echoes the first line once released
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		line, err := buf.ReadString('\n')
+		if err != nil {
+			return
+		}
+		started <- struct{}{}
+		<-release
+		conn.Write([]byte(line))
+	}))
+	defer receiver.Close()
+	var releaseOnce sync.Once
+	releaseAll := func() { releaseOnce.Do(func() { close(release) }) }
+	defer releaseAll()
+
+	s := NewServer()
+	s.SetLogger(logger)
+	clients := httptest.NewServer(http.HandlerFunc(createClientsHTTPHandler(s)))
+	defer clients.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(createPublicHTTPHandler(s)))
+	defer proxy.Close()
+	c := &client.Client{HTTPHosts: []string{"www.example.com"}, Logger: logger}
+	go c.Run(strings.TrimPrefix(clients.URL, "http://"), nil, strings.TrimPrefix(receiver.URL, "http://"))
+	defer c.Shutdown(time.Second)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s.Registry().Get("www.example.com")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("The client did not register")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: www.example.com\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected the protocols to be switched, got %v %v", resp, err)
+	}
+	conn.Write([]byte("hello\n"))
+	<-started
+	shutdownDone := make(chan error, 1)
+	go func() {
+		shutdownDone <- s.Shutdown(5 * time.Second)
+	}()
+	select {
+	case <-shutdownDone:
+		t.Fatal("Shutdown returned before the upgraded connection completed")
+	case <-time.After(200 * time.Millisecond):
+	}
+	releaseAll()
+	if line, err := reader.ReadString('\n'); err != nil || line != "hello\n" {
+		t.Fatalf("Expected the upgraded connection to complete, got %q %v", line, err)
+	}
+	conn.Close()
+	select {
+	case <-shutdownDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+}
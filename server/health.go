@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/samalba/skyproxy/utils"
+)
+
+// Default health checks settings, used when the Server fields are not set
+const (
+	DefaultHealthInterval     = 10 * time.Second
+	DefaultHealthTimeout      = 5 * time.Second
+	DefaultUnhealthyThreshold = 3
+	DefaultHealthyThreshold   = 2
+)
+
+var errPingTimeout = errors.New("Ping timeout")
+
+// clientHealth is the health state of a Client, updated by the health checks
+type clientHealth struct {
+	lock      sync.Mutex
+	unhealthy bool
+	rtt       time.Duration
+	lastError error
+	// successes and failures count the consecutive checks results
+	successes int
+	failures  int
+	// pinging is set while a ping is in flight
+	pinging bool
+	// notReady is set when the Client reports its receivers are not ready
+	notReady       bool
+	notReadyReason string
+	// draining is set when the Client announces it stops accepting streams
+	draining bool
+}
+
+// Healthy returns false when the Client failed its last health checks, it is
+// then excluded from the selection
+func (c *Client) Healthy() bool {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	return !c.health.unhealthy
+}
+
+// RTT returns the round trip time measured by the last ping
+func (c *Client) RTT() time.Duration {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	return c.health.rtt
+}
+
+// availableClients returns the Clients of a list which are healthy, ready and
+// not draining
+func availableClients(clients []*Client) []*Client {
+	healthy := make([]*Client, 0, len(clients))
+	for _, client := range clients {
+		if client.Healthy() && client.Ready() && !client.Draining() {
+			healthy = append(healthy, client)
+		}
+	}
+	return healthy
+}
+
+// ping measures the RTT of the session, it gives up after the timeout. Only
+// one ping is sent at a time since Session.Ping cannot be cancelled.
+func (c *Client) ping(timeout time.Duration) (time.Duration, error) {
+	c.health.lock.Lock()
+	if c.health.pinging {
+		c.health.lock.Unlock()
+		return 0, errPingTimeout
+	}
+	c.health.pinging = true
+	c.health.lock.Unlock()
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rtt, err := c.Session.Ping()
+		c.health.lock.Lock()
+		c.health.pinging = false
+		c.health.lock.Unlock()
+		done <- result{rtt, err}
+	}()
+	select {
+	case res := <-done:
+		return res.rtt, res.err
+	case <-time.After(timeout):
+		return 0, errPingTimeout
+	}
+}
+
+// probe sends an HTTP request to the health path of the Client through the
+// tunnel, any 2xx or 3xx response is a success
+func (c *Client) probe(timeout time.Duration) error {
+	stream, err := c.Session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	stream.SetDeadline(time.Now().Add(timeout))
+	req, err := http.NewRequest("GET", c.HealthPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Host = c.probeHost()
+	req.Close = true
+	req.Header.Set("User-Agent", "skyproxy-healthcheck/"+utils.Version)
+	if err := req.Write(stream); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(stream), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("Health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// probeHost returns the Host header of the health probe, the first host which
+// is not a wildcard
+func (c *Client) probeHost() string {
+	for _, host := range c.HTTPHosts {
+		if !utils.IsWildcardHost(host) {
+			return host
+		}
+	}
+	return "localhost"
+}
+
+// recordHealth updates the health state after a check, it returns true if the
+// state changed
+func (c *Client) recordHealth(rtt time.Duration, err error, healthyThreshold, unhealthyThreshold int) bool {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	c.health.lastError = err
+	if err != nil {
+		c.health.successes = 0
+		c.health.failures++
+		if !c.health.unhealthy && c.health.failures >= unhealthyThreshold {
+			c.health.unhealthy = true
+			return true
+		}
+		return false
+	}
+	c.health.rtt = rtt
+	c.health.failures = 0
+	c.health.successes++
+	if c.health.unhealthy && c.health.successes >= healthyThreshold {
+		c.health.unhealthy = false
+		return true
+	}
+	return false
+}
+
+// checkHealth runs the health checks of a Client until its session is closed,
+// the Client is then removed from the registry
+func (s *Server) checkHealth(client *Client) {
+	interval := s.HealthInterval
+	if interval <= 0 {
+		interval = DefaultHealthInterval
+	}
+	timeout := s.HealthTimeout
+	if timeout <= 0 {
+		timeout = DefaultHealthTimeout
+	}
+	healthyThreshold := s.HealthyThreshold
+	if healthyThreshold <= 0 {
+		healthyThreshold = DefaultHealthyThreshold
+	}
+	unhealthyThreshold := s.UnhealthyThreshold
+	if unhealthyThreshold <= 0 {
+		unhealthyThreshold = DefaultUnhealthyThreshold
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if client.Session.IsClosed() {
+			if s.registry.Remove(client) {
+				client.log.Info("Client session closed")
+				client.Close()
+			}
+			return
+		}
+		rtt, err := client.ping(timeout)
+		if err == nil && client.HealthPath != "" {
+			err = client.probe(timeout)
+		}
+		if client.recordHealth(rtt, err, healthyThreshold, unhealthyThreshold) {
+			if err != nil {
+				client.log.Warn("Client unhealthy", "error", err)
+			} else {
+				client.log.Info("Client healthy again", "rtt", rtt)
+			}
+		}
+	}
+}
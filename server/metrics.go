@@ -0,0 +1,112 @@
+package server
+
+import (
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/samalba/skyproxy/metrics"
+)
+
+// serverMetrics are the metrics exported by the Server
+type serverMetrics struct {
+	registry        *metrics.Registry
+	clients         *metrics.Gauge
+	registrations   *metrics.Counter
+	unregistrations *metrics.Counter
+	requests        *metrics.Counter
+	requestDuration *metrics.Histogram
+	bytesReceived   *metrics.Counter
+	bytesSent       *metrics.Counter
+	openFailures    *metrics.Counter
+	retries         *metrics.Counter
+	tcpConnections  *metrics.Counter
+	udpFlows        *metrics.Counter
+	upgrades        *metrics.Counter
+	upgradesActive  *metrics.Gauge
+	upgradeDuration *metrics.Histogram
+	upgradeTimeouts *metrics.Counter
+}
+
+func newServerMetrics(s *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry: r,
+		clients: r.NewGauge("skyproxy_clients",
+			"Number of Clients registered for a host", "host"),
+		registrations: r.NewCounter("skyproxy_registrations_total",
+			"Number of Client registrations for a host", "host"),
+		unregistrations: r.NewCounter("skyproxy_unregistrations_total",
+			"Number of Clients removed from a host", "host"),
+		requests: r.NewCounter("skyproxy_requests_total",
+			"Number of proxied requests by host and status code", "host", "code"),
+		requestDuration: r.NewHistogram("skyproxy_request_duration_seconds",
+			"Time to proxy a request, from its reception to the end of the response", nil, "host"),
+		bytesReceived: r.NewCounter("skyproxy_tunnel_received_bytes_total",
+			"Number of bytes received from the Clients streams", "host"),
+		bytesSent: r.NewCounter("skyproxy_tunnel_sent_bytes_total",
+			"Number of bytes sent to the Clients streams", "host"),
+		openFailures: r.NewCounter("skyproxy_stream_open_failures_total",
+			"Number of streams which could not be opened on a Client session", "host"),
+		retries: r.NewCounter("skyproxy_stream_retries_total",
+			"Number of times another Client was picked after a stream open failure", "host"),
+		tcpConnections: r.NewCounter("skyproxy_tcp_connections_total",
+			"Number of TCP and TLS passthrough connections tunneled to the Clients", "host"),
+		udpFlows: r.NewCounter("skyproxy_udp_flows_total",
+			"Number of UDP flows (source addresses) tunneled to the Clients", "host"),
+		upgrades: r.NewCounter("skyproxy_upgraded_connections_total",
+			"Number of connections upgraded to another protocol (WebSocket...)", "host", "protocol"),
+		upgradesActive: r.NewGauge("skyproxy_upgraded_connections_active",
+			"Number of upgraded connections currently open", "host"),
+		upgradeDuration: r.NewHistogram("skyproxy_upgraded_connection_duration_seconds",
+			"Lifetime of the upgraded connections", []float64{1, 10, 60, 300, 900, 1800, 3600, 14400}, "host"),
+		upgradeTimeouts: r.NewCounter("skyproxy_upgraded_connection_idle_timeouts_total",
+			"Number of upgraded connections closed because they were idle", "host"),
+	}
+	s.registry.registrations = m.registrations
+	s.registry.unregistrations = m.unregistrations
+	r.OnCollect(func() {
+		m.clients.Reset()
+		for host, clients := range s.registry.List() {
+			m.clients.Set(float64(len(clients)), host)
+		}
+	})
+	return m
+}
+
+// observeRequest records a proxied request, conn is nil when no stream was
+// opened
+func (m *serverMetrics) observeRequest(host string, code int, start time.Time, conn *countingConn) {
+	m.requests.Inc(host, strconv.Itoa(code))
+	m.requestDuration.Observe(time.Since(start).Seconds(), host)
+	if conn != nil {
+		m.observeTunnel(host, conn)
+	}
+}
+
+// observeTunnel records the bytes of a stream once it is closed
+func (m *serverMetrics) observeTunnel(host string, conn *countingConn) {
+	m.bytesReceived.Add(float64(atomic.LoadUint64(&conn.bytesIn)), host)
+	m.bytesSent.Add(float64(atomic.LoadUint64(&conn.bytesOut)), host)
+}
+
+// upgradeStarted records a connection switching protocols
+func (m *serverMetrics) upgradeStarted(host, protocol string) {
+	m.upgrades.Inc(host, protocol)
+	m.upgradesActive.Add(1, host)
+}
+
+// upgradeDone records the end of an upgraded connection
+func (m *serverMetrics) upgradeDone(host string, start time.Time, timedOut bool) {
+	m.upgradesActive.Add(-1, host)
+	m.upgradeDuration.Observe(time.Since(start).Seconds(), host)
+	if timedOut {
+		m.upgradeTimeouts.Inc(host)
+	}
+}
+
+// Metrics returns the metrics of the Server, they are exported on /metrics by
+// the admin server
+func (s *Server) Metrics() *metrics.Registry {
+	return s.metrics.registry
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/samalba/skyproxy/utils"
+)
+
+// tlsHostPrefix prefixes the hosts of the TLS passthrough Clients in the
+// Registry, an HTTP request cannot match them
+const tlsHostPrefix = "tls:"
+
+// clientHelloTimeout is the time given to a visitor to send its ClientHello
+const clientHelloTimeout = 10 * time.Second
+
+// errClientHelloRead stops the TLS handshake once the ClientHello is read
+var errClientHelloRead = errors.New("ClientHello read")
+
+// readOnlyConn feeds the ClientHello to a TLS handshake, nothing is written
+// back to the visitor
+type readOnlyConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c readOnlyConn) Read(b []byte) (int, error)  { return c.reader.Read(b) }
+func (c readOnlyConn) Write(b []byte) (int, error) { return 0, io.ErrClosedPipe }
+
+// readServerName reads the ClientHello of a TLS connection and returns the
+// SNI server name and the bytes read, they are replayed to the Client
+func readServerName(conn net.Conn) (string, []byte, error) {
+	head := &bytes.Buffer{}
+	serverName := ""
+	err := tls.Server(readOnlyConn{Conn: conn, reader: io.TeeReader(conn, head)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if serverName == "" {
+		if err == nil || err == errClientHelloRead {
+			err = errors.New("No server name in the ClientHello")
+		}
+		return "", nil, err
+	}
+	return serverName, head.Bytes(), nil
+}
+
+// lookupTLSClients returns the TLS passthrough Clients for a server name and
+// the Registry key they matched, the most specific match wins
+func (s *Server) lookupTLSClients(serverName string) (string, []*Client) {
+	for _, pattern := range utils.HostPatterns(utils.NormalizeHost(serverName)) {
+		if clients := s.registry.Get(tlsHostPrefix + pattern); len(clients) > 0 {
+			return tlsHostPrefix + pattern, clients
+		}
+	}
+	return "", nil
+}
+
+// StartPassthroughServer accepts TLS connections and forwards them untouched
+// to the Client registered for their SNI server name, the TLS session is
+// terminated by the receiver. It returns nil once stopped by Shutdown.
+func (s *Server) StartPassthroughServer(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	if !s.addListener(listener) {
+		listener.Close()
+		return nil
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			if s.isShuttingDown() {
+				return nil
+			}
+			return err
+		}
+		if !s.startTunnel() {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.tunnelDone()
+			s.forwardTLS(conn)
+		}()
+	}
+}
+
+// forwardTLS routes a TLS connection on its SNI server name
+func (s *Server) forwardTLS(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+	serverName, head, err := readServerName(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		s.log.Info("Cannot read the TLS server name", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+	host, _ := s.lookupTLSClients(serverName)
+	if host == "" {
+		s.log.Info("Cannot handle TLS connection", "host", serverName,
+			"remote_addr", conn.RemoteAddr().String(), "error", errNoClient)
+		conn.Close()
+		return
+	}
+	s.forwardConn(host, conn, head)
+}
+
+// passthroughRequest is given to the Balancers for the connections which are
+// not HTTP requests, only the remote address is set
+func passthroughRequest(remoteAddr string) *http.Request {
+	return &http.Request{RemoteAddr: remoteAddr, Header: http.Header{}}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"bufio"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/samalba/skyproxy/logging"
+)
+
+// hopHeaders are meaningful only for a single transport-level connection,
+// they are not forwarded by the proxy (see RFC 2616, section 13.5.1)
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// errorPageTemplate is the page sent to the visitors when a request cannot be
+// proxied
+var errorPageTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head><title>{{.Code}} {{.Status}}</title></head>
+<body>
+<h1>{{.Code}} {{.Status}}</h1>
+<p>{{.Message}}</p>
+<hr><p>skyproxy</p>
+</body>
+</html>
+`))
+
+// writeErrorPage replies to the visitor with an HTML error page
+func writeErrorPage(w http.ResponseWriter, code int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	errorPageTemplate.Execute(w, struct {
+		Code    int
+		Status  string
+		Message string
+	}{code, http.StatusText(code), message})
+}
+
+// copyHeader adds all the values of src to dst
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+}
+
+// removeHopHeaders removes the hop-by-hop headers, including the ones listed
+// in the Connection header
+func removeHopHeaders(h http.Header) {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// upgradeProtocol returns the protocol requested by an Upgrade request (for
+// instance "websocket"), or an empty string
+func upgradeProtocol(h http.Header) string {
+	for _, f := range h["Connection"] {
+		for _, name := range strings.Split(f, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// newOutgoingRequest returns a copy of the public request, ready to be written
+// on a Yamux stream. Each stream carries exactly one request. The Upgrade
+// headers are kept, the stream is then switched to the new protocol.
+func newOutgoingRequest(r *http.Request) *http.Request {
+	out := new(http.Request)
+	*out = *r
+	out.Header = make(http.Header)
+	copyHeader(out.Header, r.Header)
+	removeHopHeaders(out.Header)
+	// The visitor already got its 100 Continue from net/http when the body is
+	// read
+	out.Header.Del("Expect")
+	if protocol := upgradeProtocol(r.Header); protocol != "" {
+		out.Header.Set("Connection", "Upgrade")
+		out.Header.Set("Upgrade", protocol)
+	} else {
+		out.Close = true
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := out.Header.Get("X-Forwarded-For"); prior != "" {
+			ip = prior + ", " + ip
+		}
+		out.Header.Set("X-Forwarded-For", ip)
+	}
+	out.Header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		out.Header.Set("X-Forwarded-Proto", "https")
+	} else {
+		out.Header.Set("X-Forwarded-Proto", "http")
+	}
+	return out
+}
+
+// copyResponse streams the response body back to the public connection. It
+// flushes after each read so long polling and server-sent events still work.
+func copyResponse(w http.ResponseWriter, body io.Reader) (int64, error) {
+	var written int64
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := body.Read(buf)
+		if n > 0 {
+			nw, werr := w.Write(buf[:n])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// outgoingRequest is newOutgoingRequest without the affinity cookie, it is
+// only meaningful to the server
+func (s *Server) outgoingRequest(r *http.Request) *http.Request {
+	out := newOutgoingRequest(r)
+	if s.Affinity == AffinityCookie {
+		removeCookie(out.Header, s.affinityCookieName())
+	}
+	return out
+}
+
+// proxyRequest forwards a single request returned by outgoingRequest on the
+// stream and sends the response back. The returned error is set only if the
+// response has not been written yet, the caller is then in charge of replying
+// with an error.
+func proxyRequest(log logging.Logger, w http.ResponseWriter, outReq *http.Request, stream net.Conn) (*http.Response, error) {
+	// The request is written in the background, the Client might reply before
+	// reading the whole body
+	writeErr := make(chan error, 1)
+	go func() {
+		writeErr <- outReq.Write(stream)
+	}()
+	reader := bufio.NewReader(stream)
+	resp, err := http.ReadResponse(reader, outReq)
+	// The interim responses (100 Continue, 103 Early Hints...) are skipped,
+	// the visitor only gets the final one
+	for err == nil && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+		resp, err = http.ReadResponse(reader, outReq)
+	}
+	if err != nil {
+		select {
+		case werr := <-writeErr:
+			if werr != nil {
+				return nil, werr
+			}
+		default:
+		}
+		return nil, err
+	}
+	writeResponse(log, w, resp)
+	return resp, nil
+}
+
+// writeResponse sends a response read from a stream back to the visitor
+func writeResponse(log logging.Logger, w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	removeHopHeaders(resp.Header)
+	copyHeader(w.Header(), resp.Header)
+	w.WriteHeader(resp.StatusCode)
+	if _, err := copyResponse(w, resp.Body); err != nil {
+		log.Warn("Cannot send the response back", "error", err)
+	}
+}
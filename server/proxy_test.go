@@ -0,0 +1,46 @@
+package server
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/samalba/skyproxy/logging"
+)
+
+// The interim responses of the receiver are not sent as the final response
+func TestProxyRequestExpectContinue(t *testing.T) {
+	log, _ := logging.New(ioutil.Discard, logging.FormatLogfmt, logging.LevelError)
+	r := httptest.NewRequest("POST", "http://www.example.com/upload", strings.NewReader("data"))
+	r.Header.Set("Expect", "100-continue")
+	stream, receiver := net.Pipe()
+	defer stream.Close()
+	expect := make(chan string, 1)
+	go func() {
+		defer receiver.Close()
+		req, err := http.ReadRequest(bufio.NewReader(receiver))
+		if err != nil {
+			expect <- err.Error()
+			return
+		}
+		expect <- req.Header.Get("Expect")
+		receiver.Write([]byte("HTTP/1.1 100 Continue\r\n\r\n"))
+		ioutil.ReadAll(req.Body)
+		receiver.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+	}()
+	w := httptest.NewRecorder()
+	resp, err := proxyRequest(log, w, newOutgoingRequest(r), stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := <-expect; value != "" {
+		t.Errorf("Expected the Expect header to be removed, got %q", value)
+	}
+	if resp.StatusCode != http.StatusOK || w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Fatalf("Expected the final response 200 \"hello\", got %d %q", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/yamux"
+	"github.com/samalba/skyproxy/logging"
+	"github.com/samalba/skyproxy/utils"
+)
+
+// newSessionID returns a random identifier for a Client session
+func newSessionID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// rejectRegistration replies to a registration request which cannot be
+// accepted
+func rejectRegistration(log logging.Logger, w http.ResponseWriter, status int, code, reason string) {
+	log.Info("Cannot register new client", "code", code, "reason", reason)
+	body, err := json.Marshal(&utils.RegisterResponse{
+		Accepted:        false,
+		ProtocolVersion: utils.ProtocolVersion,
+		ServerVersion:   utils.Version,
+		Code:            code,
+		Reason:          reason,
+	})
+	if err != nil {
+		http.Error(w, reason, status)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+const (
+	// maxHostsPerClient limits the number of hosts registered by a single
+	// Client
+	maxHostsPerClient = 64
+	// maxClientWeight is the maximum weight advertised by a Client
+	maxClientWeight = 1000
+)
+
+// registrationHosts returns the normalized list of hosts requested by a
+// Client, without duplicates. The Host header is used when the hosts header is
+// not set.
+func registrationHosts(r *http.Request) []string {
+	values := r.Header[http.CanonicalHeaderKey(utils.HostsHeader)]
+	if len(values) == 0 {
+		if r.Host == "" {
+			return nil
+		}
+		return []string{utils.NormalizeHost(r.Host)}
+	}
+	hosts := []string{}
+	seen := make(map[string]bool)
+	for _, value := range values {
+		for _, host := range strings.Split(value, ",") {
+			host = utils.NormalizeHost(host)
+			if host == "" || seen[host] {
+				continue
+			}
+			seen[host] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// registrationRequest is a validated registration request
+type registrationRequest struct {
+	hosts []string
+	// tcp is set for a TCP Client, tcpPort is the requested port (0 when
+	// the server assigns it)
+	tcp     bool
+	tcpPort int
+	// udp and udpPort are the same for a UDP Client
+	udp     bool
+	udpPort int
+}
+
+// validateRegistration checks the registration request before the connection
+// is hijacked. It returns what to register, or false after replying if the
+// request is invalid.
+func (s *Server) validateRegistration(w http.ResponseWriter, r *http.Request) (*registrationRequest, bool) {
+	if r.Method != "POST" {
+		rejectRegistration(s.log, w, http.StatusMethodNotAllowed, utils.RejectInvalidRequest,
+			fmt.Sprintf("Method %s not allowed", r.Method))
+		return nil, false
+	}
+	version, err := strconv.Atoi(r.Header.Get(utils.ProtocolVersionHeader))
+	if err != nil || version != utils.ProtocolVersion {
+		rejectRegistration(s.log, w, http.StatusBadRequest, utils.RejectUnsupportedVersion,
+			fmt.Sprintf("Unsupported protocol version %q, expected %d",
+				r.Header.Get(utils.ProtocolVersionHeader), utils.ProtocolVersion))
+		return nil, false
+	}
+	if weight := r.Header.Get(utils.WeightHeader); weight != "" {
+		if n, err := strconv.Atoi(weight); err != nil || n < 1 || n > maxClientWeight {
+			rejectRegistration(s.log, w, http.StatusBadRequest, utils.RejectInvalidRequest,
+				fmt.Sprintf("Invalid weight %q, expected a number between 1 and %d", weight, maxClientWeight))
+			return nil, false
+		}
+	}
+	if path := r.Header.Get(utils.HealthPathHeader); path != "" && !strings.HasPrefix(path, "/") {
+		rejectRegistration(s.log, w, http.StatusBadRequest, utils.RejectInvalidRequest,
+			fmt.Sprintf("Invalid health path %q, it must start with /", path))
+		return nil, false
+	}
+	mode := r.Header.Get(utils.ModeHeader)
+	switch mode {
+	case "", utils.ModeHTTP, utils.ModeTLS:
+	case utils.ModeTCP:
+		return s.validateTCPRegistration(w, r)
+	case utils.ModeUDP:
+		return s.validateUDPRegistration(w, r)
+	default:
+		rejectRegistration(s.log, w, http.StatusBadRequest, utils.RejectInvalidRequest,
+			fmt.Sprintf("Unsupported mode %q", mode))
+		return nil, false
+	}
+	hosts := registrationHosts(r)
+	if len(hosts) == 0 {
+		rejectRegistration(s.log, w, http.StatusBadRequest, utils.RejectInvalidRequest, "No Host header specified")
+		return nil, false
+	}
+	if len(hosts) > maxHostsPerClient {
+		rejectRegistration(s.log, w, http.StatusBadRequest, utils.RejectInvalidRequest,
+			fmt.Sprintf("Too many hosts (%d), the maximum is %d", len(hosts), maxHostsPerClient))
+		return nil, false
+	}
+	for _, host := range hosts {
+		if !utils.ValidHostPattern(host) {
+			rejectRegistration(s.log, w, http.StatusBadRequest, utils.RejectInvalidRequest,
+				fmt.Sprintf("Invalid host %q, a wildcard is only allowed as the first label", host))
+			return nil, false
+		}
+		if !s.authorizeHost(w, r, host) {
+			return nil, false
+		}
+	}
+	if mode == utils.ModeTLS {
+		// The TLS passthrough Clients are indexed apart from the HTTP ones
+		for i, host := range hosts {
+			hosts[i] = tlsHostPrefix + host
+		}
+	}
+	return &registrationRequest{hosts: hosts}, true
+}
+
+// validateTCPRegistration checks the port requested by a TCP Client, it is
+// authorized as the host "tcp:<port>", or "tcp:*" when the server assigns it
+func (s *Server) validateTCPRegistration(w http.ResponseWriter, r *http.Request) (*registrationRequest, bool) {
+	if !s.TCPEnabled() {
+		rejectRegistration(s.log, w, http.StatusForbidden, utils.RejectForbiddenHost, "TCP tunnels are disabled")
+		return nil, false
+	}
+	port, err := strconv.Atoi(r.Header.Get(utils.TCPPortHeader))
+	if err != nil || !s.validTCPPort(port) {
+		rejectRegistration(s.log, w, http.StatusBadRequest, utils.RejectInvalidRequest,
+			fmt.Sprintf("Invalid TCP port %q, expected 0 or a port between %d and %d",
+				r.Header.Get(utils.TCPPortHeader), s.TCPPortMin, s.TCPPortMax))
+		return nil, false
+	}
+	host := tcpHostPrefix + "*"
+	if port != 0 {
+		host = tcpHost(port)
+	}
+	if !s.authorizeHost(w, r, host) {
+		return nil, false
+	}
+	return &registrationRequest{tcp: true, tcpPort: port}, true
+}
+
+// authorizeHost checks the Client credentials allow registering the host, it
+// returns false after replying otherwise
+func (s *Server) authorizeHost(w http.ResponseWriter, r *http.Request, host string) bool {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if err := s.ClientCerts.Authorize(r.TLS.VerifiedChains[0][0], host); err != nil {
+			rejectRegistration(s.log, w, http.StatusForbidden, utils.RejectForbiddenHost, err.Error())
+			return false
+		}
+	} else if s.RequireClientCert || s.ClientCerts != nil {
+		rejectRegistration(s.log, w, http.StatusUnauthorized, utils.RejectUnauthorized, errMissingClientCert.Error())
+		return false
+	}
+	if s.Tokens != nil {
+		if err := s.Tokens.Authorize(bearerToken(r), host); err != nil {
+			if err == errMissingToken || err == errInvalidToken {
+				rejectRegistration(s.log, w, http.StatusUnauthorized, utils.RejectUnauthorized, err.Error())
+			} else {
+				rejectRegistration(s.log, w, http.StatusForbidden, utils.RejectForbiddenHost, err.Error())
+			}
+			return false
+		}
+	}
+	return true
+}
+
+// acceptRegistration writes the Switching Protocols response on the hijacked
+// connection, the Yamux session starts right after it
+func acceptRegistration(bufrw *bufio.ReadWriter, resp *utils.RegisterResponse) error {
+	body, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(bufrw, "HTTP/1.1 %d %s\r\n", http.StatusSwitchingProtocols,
+		http.StatusText(http.StatusSwitchingProtocols))
+	fmt.Fprintf(bufrw, "Connection: Upgrade\r\n")
+	fmt.Fprintf(bufrw, "Upgrade: %s/%d\r\n", utils.ProtocolName, utils.ProtocolVersion)
+	fmt.Fprintf(bufrw, "Content-Type: application/json\r\n")
+	fmt.Fprintf(bufrw, "Content-Length: %d\r\n\r\n", len(body))
+	bufrw.Write(body)
+	return bufrw.Flush()
+}
+
+// registerLimits returns the limits advertised to the Clients for a Yamux
+// configuration
+func registerLimits(config *yamux.Config) *utils.RegisterLimits {
+	return &utils.RegisterLimits{
+		MaxPendingStreams: config.AcceptBacklog,
+		KeepAliveInterval: int(config.KeepAliveInterval.Seconds()),
+	}
+}
+
+// validateUDPRegistration checks the port requested by a UDP Client, it is
+// authorized as the host "udp:<port>", or "udp:*" when the server assigns it
+func (s *Server) validateUDPRegistration(w http.ResponseWriter, r *http.Request) (*registrationRequest, bool) {
+	if !s.UDPEnabled() {
+		rejectRegistration(s.log, w, http.StatusForbidden, utils.RejectForbiddenHost, "UDP tunnels are disabled")
+		return nil, false
+	}
+	port, err := strconv.Atoi(r.Header.Get(utils.UDPPortHeader))
+	if err != nil || !s.validUDPPort(port) {
+		rejectRegistration(s.log, w, http.StatusBadRequest, utils.RejectInvalidRequest,
+			fmt.Sprintf("Invalid UDP port %q, expected 0 or a port between %d and %d",
+				r.Header.Get(utils.UDPPortHeader), s.UDPPortMin, s.UDPPortMax))
+		return nil, false
+	}
+	host := udpHostPrefix + "*"
+	if port != 0 {
+		host = udpHost(port)
+	}
+	if !s.authorizeHost(w, r, host) {
+		return nil, false
+	}
+	return &registrationRequest{udp: true, udpPort: port}, true
+}
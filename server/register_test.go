@@ -0,0 +1,44 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/samalba/skyproxy/logging"
+)
+
+func TestAuthorizeHostClientCert(t *testing.T) {
+	s := NewServer()
+	logger, _ := logging.New(ioutil.Discard, logging.FormatLogfmt, logging.LevelError)
+	s.SetLogger(logger)
+	s.RequireClientCert = true
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "app.example.com"}}
+	tests := []struct {
+		name   string
+		state  *tls.ConnectionState
+		host   string
+		status int
+	}{
+		{"plain HTTP", nil, "app.example.com", http.StatusUnauthorized},
+		{"no verified chain", &tls.ConnectionState{}, "app.example.com", http.StatusUnauthorized},
+		{"certificate name", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, "app.example.com", 0},
+		{"other host", &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}, "other.example.com", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest("POST", "/_skyproxy/register", nil)
+		r.TLS = test.state
+		w := httptest.NewRecorder()
+		authorized := s.authorizeHost(w, r, test.host)
+		if authorized != (test.status == 0) {
+			t.Errorf("%s: expected authorized=%v, got %v", test.name, test.status == 0, authorized)
+		}
+		if test.status != 0 && w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/samalba/skyproxy/logging"
+	"github.com/samalba/skyproxy/metrics"
+	"github.com/samalba/skyproxy/utils"
+)
+
+// RegistryEventType tells whether a Client was added, removed or is draining
+type RegistryEventType int
+
+const (
+	// ClientAdded is sent when a Client registers a Host
+	ClientAdded RegistryEventType = iota
+	// ClientRemoved is sent when a Client is removed from a Host
+	ClientRemoved
+	// ClientDraining is sent when a Client stops accepting new streams, it
+	// stays registered until its session is closed
+	ClientDraining
+)
+
+// RegistryEvent is sent to the watchers on each change of the Registry
+type RegistryEvent struct {
+	Type   RegistryEventType
+	Client *Client
+	Host   string
+	// HostClients is the number of Clients left for the Host after the change
+	HostClients int
+	// TotalClients is the number of Clients left in the Registry
+	TotalClients int
+}
+
+// watcherBufferSize is the number of events buffered for each watcher, events
+// are dropped for the watchers which do not keep up
+const watcherBufferSize = 64
+
+// Registry maps the HTTP hosts to the Clients registered for them. A Client
+// is indexed under each of its hosts. It is safe for concurrent use.
+type Registry struct {
+	lock       sync.RWMutex
+	hosts      map[string][]*Client
+	numClients int
+	watchers   []chan RegistryEvent
+	log        logging.Logger
+	// registrations and unregistrations count the changes of each host, they
+	// are not derived from the events which can be dropped
+	registrations   *metrics.Counter
+	unregistrations *metrics.Counter
+}
+
+// NewRegistry creates an empty Registry
+func NewRegistry() *Registry {
+	return &Registry{hosts: make(map[string][]*Client), log: logging.Default()}
+}
+
+// Add registers a Client for all its HTTP hosts
+func (r *Registry) Add(client *Client) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.numClients++
+	for _, host := range client.HTTPHosts {
+		r.hosts[host] = append(r.hosts[host], client)
+		if r.registrations != nil {
+			r.registrations.Inc(host)
+		}
+		r.notify(RegistryEvent{
+			Type:         ClientAdded,
+			Client:       client,
+			Host:         host,
+			HostClients:  len(r.hosts[host]),
+			TotalClients: r.numClients,
+		})
+	}
+}
+
+// Remove unregisters a Client from all its HTTP hosts, it returns false if
+// the Client was not registered (for instance if it has already been removed)
+func (r *Registry) Remove(client *Client) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	removed := false
+	for _, host := range client.HTTPHosts {
+		if r.removeFromHost(client, host) {
+			if !removed {
+				r.numClients--
+				removed = true
+			}
+			if r.unregistrations != nil {
+				r.unregistrations.Inc(host)
+			}
+			r.notify(RegistryEvent{
+				Type:         ClientRemoved,
+				Client:       client,
+				Host:         host,
+				HostClients:  len(r.hosts[host]),
+				TotalClients: r.numClients,
+			})
+		}
+	}
+	return removed
+}
+
+// Drain marks a registered Client as draining, the Client is not selected for
+// new requests anymore. It returns false if the Client is not registered or
+// already draining.
+func (r *Registry) Drain(client *Client) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if !r.contains(client) || !client.setDraining() {
+		return false
+	}
+	for _, host := range client.HTTPHosts {
+		r.notify(RegistryEvent{
+			Type:         ClientDraining,
+			Client:       client,
+			Host:         host,
+			HostClients:  len(r.hosts[host]),
+			TotalClients: r.numClients,
+		})
+	}
+	return true
+}
+
+// contains must be called with the lock held
+func (r *Registry) contains(client *Client) bool {
+	for _, host := range client.HTTPHosts {
+		for _, c := range r.hosts[host] {
+			if c == client {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeFromHost must be called with the lock held
+func (r *Registry) removeFromHost(client *Client, host string) bool {
+	l := r.hosts[host]
+	for i, c := range l {
+		if c != client {
+			continue
+		}
+		// Do not modify the slice in place, it might be used by Lookup callers
+		newList := make([]*Client, 0, len(l)-1)
+		newList = append(newList, l[:i]...)
+		newList = append(newList, l[i+1:]...)
+		if len(newList) == 0 {
+			delete(r.hosts, host)
+		} else {
+			r.hosts[host] = newList
+		}
+		return true
+	}
+	return false
+}
+
+// registryKey normalizes a host given by a Client or by the admin API. The
+// "tcp:<port>" and "udp:<port>" keys are kept and the host of the "tls:<host>" keys is
+// normalized, NormalizeHost would take the prefix for a host name.
+func registryKey(host string) string {
+	key := strings.ToLower(strings.TrimSpace(host))
+	switch {
+	case strings.HasPrefix(key, tcpHostPrefix), strings.HasPrefix(key, udpHostPrefix):
+		return key
+	case strings.HasPrefix(key, tlsHostPrefix):
+		return tlsHostPrefix + utils.NormalizeHost(strings.TrimPrefix(key, tlsHostPrefix))
+	}
+	return utils.NormalizeHost(host)
+}
+
+// Lookup returns the Clients registered for a host. The host is normalized
+// and matched against the registered hosts, the most specific match wins: an
+// exact match first, then the wildcards from the longest to the shortest
+// domain, then "*".
+func (r *Registry) Lookup(host string) []*Client {
+	_, clients := r.Match(host)
+	return clients
+}
+
+// Get returns the Clients registered for exactly this key, without matching
+// the wildcards
+func (r *Registry) Get(host string) []*Client {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.hosts[host]
+}
+
+// Match is like Lookup, it also returns the registered host which matched
+func (r *Registry) Match(host string) (string, []*Client) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	host = utils.NormalizeHost(host)
+	if strings.HasPrefix(host, tcpHostPrefix) || strings.HasPrefix(host, udpHostPrefix) ||
+		strings.HasPrefix(host, tlsHostPrefix) {
+		// The TCP, UDP and TLS passthrough Clients are not reachable over HTTP
+		return "", nil
+	}
+	for _, pattern := range utils.HostPatterns(host) {
+		if l, exists := r.hosts[pattern]; exists {
+			clients := make([]*Client, len(l))
+			copy(clients, l)
+			return pattern, clients
+		}
+	}
+	return "", nil
+}
+
+// List returns a snapshot of all the hosts and their Clients
+func (r *Registry) List() map[string][]*Client {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	hosts := make(map[string][]*Client, len(r.hosts))
+	for host, l := range r.hosts {
+		clients := make([]*Client, len(l))
+		copy(clients, l)
+		hosts[host] = clients
+	}
+	return hosts
+}
+
+// Len returns the total number of Clients, a Client registered for several
+// hosts is counted once
+func (r *Registry) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.numClients
+}
+
+// Watch returns a channel receiving all the future changes of the Registry
+func (r *Registry) Watch() <-chan RegistryEvent {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	ch := make(chan RegistryEvent, watcherBufferSize)
+	r.watchers = append(r.watchers, ch)
+	return ch
+}
+
+// Unwatch stops sending the changes to a channel returned by Watch, the
+// channel is closed
+func (r *Registry) Unwatch(ch <-chan RegistryEvent) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for i, w := range r.watchers {
+		if w == ch {
+			r.watchers = append(r.watchers[:i], r.watchers[i+1:]...)
+			close(w)
+			return
+		}
+	}
+}
+
+// notify must be called with the lock held
+func (r *Registry) notify(event RegistryEvent) {
+	for _, w := range r.watchers {
+		select {
+		case w <- event:
+		default:
+			r.log.Warn("Registry watcher is too slow, dropping event", "host", event.Host)
+		}
+	}
+}
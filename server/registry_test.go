@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/samalba/skyproxy/logging"
+	"github.com/samalba/skyproxy/metrics"
+)
+
+func newTestRegistry() *Registry {
+	r := NewRegistry()
+	r.log, _ = logging.New(ioutil.Discard, logging.FormatLogfmt, logging.LevelError)
+	return r
+}
+
+func TestRegistryMatch(t *testing.T) {
+	r := newTestRegistry()
+	exact := &Client{ID: "exact", HTTPHosts: []string{"www.example.com"}}
+	wildcard := &Client{ID: "wildcard", HTTPHosts: []string{"*.example.com"}}
+	catchAll := &Client{ID: "catch-all", HTTPHosts: []string{"*"}}
+	r.Add(exact)
+	r.Add(wildcard)
+	r.Add(catchAll)
+	// The TLS passthrough Clients are not reachable over HTTP
+	r.Add(&Client{ID: "tls", HTTPHosts: []string{tlsHostPrefix + "www.example.com"}})
+	tests := []struct {
+		host    string
+		pattern string
+		client  *Client
+	}{
+		{"www.example.com", "www.example.com", exact},
+		{"WWW.Example.com.:8080", "www.example.com", exact},
+		{"api.example.com", "*.example.com", wildcard},
+		{"a.b.example.com", "*.example.com", wildcard},
+		{"example.org", "*", catchAll},
+		{"tls:www.example.com", "*", catchAll},
+		{"", "*", catchAll},
+	}
+	for _, test := range tests {
+		pattern, clients := r.Match(test.host)
+		if pattern != test.pattern {
+			t.Errorf("Match(%q): expected pattern %q, got %q", test.host, test.pattern, pattern)
+		}
+		if len(clients) != 1 || clients[0] != test.client {
+			t.Errorf("Match(%q): expected client %s, got %v", test.host, test.client.ID, clients)
+		}
+	}
+}
+
+func TestRegistryKey(t *testing.T) {
+	tests := []struct {
+		host string
+		key  string
+	}{
+		{"www.example.com", "www.example.com"},
+		{" WWW.Example.com.:8080", "www.example.com"},
+		{"*.example.com", "*.example.com"},
+		{"tcp:2222", "tcp:2222"},
+		{"TCP:*", "tcp:*"},
+		{"udp:21000", "udp:21000"},
+		{"tls:www.example.com", "tls:www.example.com"},
+		{"TLS:*.Example.com.", "tls:*.example.com"},
+	}
+	for _, test := range tests {
+		if key := registryKey(test.host); key != test.key {
+			t.Errorf("registryKey(%q): expected %q, got %q", test.host, test.key, key)
+		}
+	}
+
+	// The maintenance mode is set on the Registry keys
+	s := NewServer()
+	s.SetMaintenance("TLS:WWW.Example.com", true)
+	if !s.InMaintenance(tlsHostPrefix+"www.example.com") || s.InMaintenance(tlsHostPrefix+"api.example.com") {
+		t.Errorf("Expected only tls:www.example.com in maintenance, got %v", s.maintenance)
+	}
+}
+
+func TestRegistryAddRemove(t *testing.T) {
+	r := newTestRegistry()
+	events := r.Watch()
+	client := &Client{ID: "a", HTTPHosts: []string{"a.example.com", "b.example.com"}}
+	r.Add(client)
+	if r.Len() != 1 {
+		t.Fatalf("Expected 1 client, got %d", r.Len())
+	}
+	if !r.Remove(client) {
+		t.Fatal("Expected the client to be removed")
+	}
+	if r.Remove(client) {
+		t.Fatal("Expected the second removal to be a no-op")
+	}
+	if r.Len() != 0 || len(r.List()) != 0 {
+		t.Fatalf("Expected an empty registry, got %d clients and %d hosts", r.Len(), len(r.List()))
+	}
+	r.Unwatch(events)
+	var types []RegistryEventType
+	for event := range events {
+		types = append(types, event.Type)
+	}
+	expected := []RegistryEventType{ClientAdded, ClientAdded, ClientRemoved, ClientRemoved}
+	if fmt.Sprint(types) != fmt.Sprint(expected) {
+		t.Fatalf("Expected the events %v, got %v", expected, types)
+	}
+}
+
+// The registrations are counted even when the events are dropped
+func TestRegistryCounters(t *testing.T) {
+	r := newTestRegistry()
+	m := metrics.NewRegistry()
+	r.registrations = m.NewCounter("registrations_total", "", "host")
+	r.unregistrations = m.NewCounter("unregistrations_total", "", "host")
+	events := r.Watch()
+	defer r.Unwatch(events)
+	const clients = 2 * watcherBufferSize
+	for i := 0; i < clients; i++ {
+		client := &Client{ID: fmt.Sprint(i), HTTPHosts: []string{"www.example.com"}}
+		r.Add(client)
+		r.Remove(client)
+	}
+	var out bytes.Buffer
+	m.WriteTo(&out)
+	for _, name := range []string{"registrations_total", "unregistrations_total"} {
+		expected := fmt.Sprintf("%s{host=\"www.example.com\"} %d\n", name, clients)
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("Expected %q in the metrics, got:\n%s", expected, out.String())
+		}
+	}
+}
+
+// TestRegistryConcurrent is meant to be run with the race detector
+func TestRegistryConcurrent(t *testing.T) {
+	r := newTestRegistry()
+	const workers = 8
+	const iterations = 200
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(4)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				client := &Client{
+					ID:        fmt.Sprintf("%d-%d", w, i),
+					HTTPHosts: []string{fmt.Sprintf("host%d.example.com", i%5), "*.example.com"},
+				}
+				r.Add(client)
+				r.Drain(client)
+				r.Remove(client)
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				for _, client := range r.Lookup(fmt.Sprintf("host%d.example.com", i%5)) {
+					_ = client.ID
+				}
+				r.Match("other.example.com")
+				r.Get("*.example.com")
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				for _, clients := range r.List() {
+					_ = len(clients)
+				}
+				r.Len()
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations/10; i++ {
+				ch := r.Watch()
+				select {
+				case <-ch:
+				default:
+				}
+				r.Unwatch(ch)
+				for range ch {
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if r.Len() != 0 || len(r.List()) != 0 {
+		t.Fatalf("Expected an empty registry, got %d clients and %d hosts", r.Len(), len(r.List()))
+	}
+}
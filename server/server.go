@@ -1,191 +1,583 @@
 package server
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
-	"log"
-	"math/rand"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/yamux"
+	"github.com/samalba/skyproxy/control"
+	"github.com/samalba/skyproxy/logging"
 	"github.com/samalba/skyproxy/utils"
 )
 
 // Client context
-// each struct represents a skyproxy Client (with the HTTPHost it registered)
+// each struct represents a skyproxy Client (with the HTTPHosts it registered)
 type Client struct {
-	Conn     net.Conn
-	Session  *yamux.Session
-	HTTPHost string
+	// ID is the session ID sent back to the Client during the registration
+	ID string
+	// Version is the version of Skyproxy announced by the Client
+	Version string
+	// Weight is used by the weighted Balancer, it is advertised by the Client
+	// at registration
+	Weight int
+	// HealthPath is requested through the tunnel by the health checks, only
+	// the session is pinged when it is not set
+	HealthPath string
+	Conn       net.Conn
+	Session    *yamux.Session
+	HTTPHosts  []string
+	// log adds the Client fields to the Server logger
+	log logging.Logger
+	// TCPPort is the port tunneled to a TCP Client, HTTPHosts is then only
+	// made of its Registry key
+	TCPPort int
+	// UDPPort is the port tunneled to a UDP Client, like TCPPort
+	UDPPort int
+	// ConnectedAt is the time of the registration
+	ConnectedAt time.Time
+	// release frees the resources reserved for the Client
+	release func()
+	health  clientHealth
+	traffic clientTraffic
+	// control is the control stream opened by the Client
+	control     *control.Conn
+	controlLock sync.Mutex
+}
+
+func (c *Client) weight() int {
+	if c.Weight <= 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+// Close closes the Client session and its connection
+func (c *Client) Close() {
+	c.Session.Close()
+	c.Conn.Close()
+	if c.release != nil {
+		c.release()
+	}
 }
 
 // Server context
 type Server struct {
-	clientList map[string][]*Client
-	numClients int
-	clientIn   chan *Client
-	clientOut  chan *Client
-	random     *rand.Rand
+	// Tokens authorizes the Clients registrations, the registration is open
+	// to anyone when it is not set
+	Tokens *TokenStore
+	// ClientCerts authorizes the registrations of the Clients using a TLS
+	// client certificate, the certificate names are used as host patterns when
+	// it is not set
+	ClientCerts *CertAuthorizer
+	// RequireClientCert rejects the registrations without a verified TLS
+	// client certificate, it is implied when ClientCerts is set
+	RequireClientCert bool
+	// FallbackHost is a registered host receiving the requests for the hosts
+	// matching no registered host
+	FallbackHost string
+	// Affinity pins the visitors to a Client (see the Affinity* modes), it is
+	// disabled by default
+	Affinity string
+	// AffinityCookie is the name of the cookie used by the cookie affinity
+	AffinityCookie string
+	// TCPPortMin and TCPPortMax are the range of the ports the TCP Clients
+	// can register, TCP tunnels are disabled when they are not set.
+	// TCPAddress is the address the TCP ports listen on (all the interfaces
+	// when empty).
+	TCPPortMin int
+	TCPPortMax int
+	TCPAddress string
+	// UDPPortMin, UDPPortMax and UDPAddress are the same for the UDP Clients.
+	// UDPIdleTimeout is the time after which a UDP flow without traffic is
+	// closed (DefaultUDPIdleTimeout if not set).
+	UDPPortMin     int
+	UDPPortMax     int
+	UDPAddress     string
+	UDPIdleTimeout time.Duration
+	// UpgradeIdleTimeout is the time after which an upgraded connection
+	// (WebSocket...) without traffic is closed (DefaultUpgradeIdleTimeout if
+	// not set)
+	UpgradeIdleTimeout time.Duration
+	// AccessLog receives an entry per public request when it is set
+	AccessLog *AccessLog
+	// HealthInterval and HealthTimeout configure the health checks of the
+	// Clients (see the DefaultHealth* constants)
+	HealthInterval time.Duration
+	HealthTimeout  time.Duration
+	// UnhealthyThreshold is the number of consecutive failed checks after
+	// which a Client does not receive traffic anymore, HealthyThreshold the
+	// number of consecutive successful checks to receive traffic again
+	UnhealthyThreshold int
+	HealthyThreshold   int
+	registry           *Registry
+	log                logging.Logger
+	metrics            *serverMetrics
+	shutdown           shutdownState
+	tcp                tcpState
+	udp                udpState
+	// maintenance lists the hosts in maintenance mode
+	maintenance     map[string]bool
+	maintenanceLock sync.Mutex
+	// balancerNames maps the registered hosts to a Balancer name, the empty
+	// host is the default Balancer
+	balancerNames map[string]string
+	// balancers are the Balancers created for each registered host
+	balancers    map[string]Balancer
+	balancerLock sync.Mutex
 }
 
 // TLSConfig is used by the HTTP server
 type TLSConfig struct {
 	CertFile string
 	KeyFile  string
+	// ClientCAFile enables the client certificates verification, only the
+	// certificates signed by one of these CAs are accepted
+	ClientCAFile string
 }
 
 // NewServer is usually called once to create the server context
 func NewServer() *Server {
 	s := &Server{}
-	s.clientList = make(map[string][]*Client)
-	s.numClients = 0
-	s.clientIn = make(chan *Client, 10)
-	s.clientOut = make(chan *Client, 10)
-	// init rand seed
-	s.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+	s.registry = NewRegistry()
+	s.log = logging.Default()
+	s.balancerNames = map[string]string{"": DefaultBalancer}
+	s.balancers = make(map[string]Balancer)
+	s.maintenance = make(map[string]bool)
+	s.metrics = newServerMetrics(s)
+	go s.logRegistryEvents(s.registry.Watch())
 	return s
 }
 
-// manageClientList maps Client add/del to the connect/disconnect of clients
-func (s *Server) manageClientList() {
-	for {
-		var client *Client
-		select {
-		// New client
-		case client = <-s.clientIn:
-			host := client.HTTPHost
-			if l, exists := s.clientList[host]; exists {
-				// There is already one or several clients for this Hostname
-				s.clientList[host] = append(l, client)
-			} else {
-				s.clientList[host] = []*Client{client}
-				log.Printf("New HTTP host: %s", host)
+// SetBalancer sets the Balancer strategy of a registered host (see
+// NewBalancer), or the default strategy if host is empty
+func (s *Server) SetBalancer(host, name string) error {
+	if _, err := NewBalancer(name); err != nil {
+		return err
+	}
+	if host != "" {
+		host = registryKey(host)
+	}
+	s.balancerLock.Lock()
+	defer s.balancerLock.Unlock()
+	s.balancerNames[host] = name
+	// The Balancers are created again on next use
+	s.balancers = make(map[string]Balancer)
+	return nil
+}
+
+// balancerFor returns the Balancer of a registered host
+func (s *Server) balancerFor(host string) Balancer {
+	s.balancerLock.Lock()
+	defer s.balancerLock.Unlock()
+	if b, exists := s.balancers[host]; exists {
+		return b
+	}
+	name, exists := s.balancerNames[host]
+	if !exists {
+		name = s.balancerNames[""]
+	}
+	// The name has been validated by SetBalancer
+	b, _ := NewBalancer(name)
+	s.balancers[host] = b
+	return b
+}
+
+// SetAffinity sets the session affinity mode, cookieName is used by the
+// cookie mode (DefaultAffinityCookie when empty)
+func (s *Server) SetAffinity(mode, cookieName string) error {
+	if err := validAffinity(mode); err != nil {
+		return err
+	}
+	s.Affinity = mode
+	s.AffinityCookie = cookieName
+	return nil
+}
+
+// SetLogger sets the Logger of the server and of its Registry, it must be
+// called before starting the servers
+func (s *Server) SetLogger(logger logging.Logger) {
+	s.log = logger
+	s.registry.log = logger
+}
+
+// Registry returns the Clients registry of the server
+func (s *Server) Registry() *Registry {
+	return s.registry
+}
+
+// logRegistryEvents logs the connect/disconnect of clients
+func (s *Server) logRegistryEvents(events <-chan RegistryEvent) {
+	for event := range events {
+		fields := []interface{}{"host", event.Host, "client_id", event.Client.ID,
+			"host_clients", event.HostClients, "clients", event.TotalClients}
+		switch event.Type {
+		case ClientAdded:
+			if event.HostClients == 1 {
+				s.log.Info("New host", "host", event.Host)
 			}
-			s.numClients++
-			log.Printf("New client registered for HTTP host: %s", host)
-		// Removing client
-		case client = <-s.clientOut:
-			host := client.HTTPHost
-			if l, exists := s.clientList[host]; exists {
-				for i, c := range l {
-					if c == client {
-						// Removing client from the list
-						defer c.Session.Close()
-						defer c.Conn.Close()
-						s.clientList[host] = append(l[:i], l[i+1:]...)
-						log.Printf("Client unregistered for HTTP host: %s", host)
-						s.numClients--
-						break
-					}
-				}
-				if len(l) == 0 {
-					delete(s.clientList, host)
-					log.Printf("Removed HTTP host: %s", host)
-				}
+			s.log.Info("New client registered", fields...)
+		case ClientRemoved:
+			s.log.Info("Client unregistered", fields...)
+			if event.HostClients == 0 {
+				s.log.Info("Removed host", "host", event.Host)
 			}
+		case ClientDraining:
+			s.log.Info("Client draining", fields...)
 		}
-		log.Printf("%d clients connected", s.numClients)
 	}
 }
 
 // createClientsHTTPHandler returns the handler that manages Skyproxy Clients
 func createClientsHTTPHandler(s *Server) func(http.ResponseWriter, *http.Request) {
 	h := func(w http.ResponseWriter, r *http.Request) {
+		if s.isShuttingDown() {
+			rejectRegistration(s.log, w, http.StatusServiceUnavailable, utils.RejectShuttingDown, "Server shutting down")
+			return
+		}
+		reg, ok := s.validateRegistration(w, r)
+		if !ok {
+			return
+		}
+		hosts := reg.hosts
+		var release func()
+		registered := false
+		switch {
+		case reg.tcp:
+			port, rel, err := s.reserveTCPPort(reg.tcpPort)
+			if err != nil {
+				rejectRegistration(s.log, w, http.StatusServiceUnavailable, utils.RejectUnavailablePort, err.Error())
+				return
+			}
+			reg.tcpPort = port
+			hosts = []string{tcpHost(port)}
+			release = rel
+		case reg.udp:
+			port, rel, err := s.reserveUDPPort(reg.udpPort)
+			if err != nil {
+				rejectRegistration(s.log, w, http.StatusServiceUnavailable, utils.RejectUnavailablePort, err.Error())
+				return
+			}
+			reg.udpPort = port
+			hosts = []string{udpHost(port)}
+			release = rel
+		}
+		if release != nil {
+			defer func() {
+				if !registered {
+					release()
+				}
+			}()
+		}
+		config := yamux.DefaultConfig()
+		if err := yamux.VerifyConfig(config); err != nil {
+			rejectRegistration(s.log, w, http.StatusInternalServerError, utils.RejectInternalError,
+				fmt.Sprintf("Cannot init Yamux Client session: %s", err))
+			return
+		}
+		id, err := newSessionID()
+		if err != nil {
+			rejectRegistration(s.log, w, http.StatusInternalServerError, utils.RejectInternalError,
+				fmt.Sprintf("Cannot generate a session ID: %s", err))
+			return
+		}
 		hj, ok := w.(http.Hijacker)
 		if !ok {
-			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-			log.Println("Cannot register new client: hijacking not supported")
+			rejectRegistration(s.log, w, http.StatusInternalServerError, utils.RejectInternalError,
+				"Hijacking not supported")
 			return
 		}
-		conn, _, err := hj.Hijack()
+		conn, bufrw, err := hj.Hijack()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("Cannot register new client: %s", err)
+			rejectRegistration(s.log, w, http.StatusInternalServerError, utils.RejectInternalError, err.Error())
 			return
 		}
-		if r.Host == "" {
-			http.Error(w, "No Host header specified", http.StatusBadRequest)
-			log.Println("Cannot register new client: no host header specified")
+		clientLog := s.log.With("client_id", id, "client_addr", conn.RemoteAddr().String())
+		err = acceptRegistration(bufrw, &utils.RegisterResponse{
+			Accepted:        true,
+			ProtocolVersion: utils.ProtocolVersion,
+			ServerVersion:   utils.Version,
+			SessionID:       id,
+			Hosts:           hosts,
+			TCPPort:         reg.tcpPort,
+			UDPPort:         reg.udpPort,
+			Limits:          registerLimits(config),
+		})
+		if err != nil {
+			clientLog.Error("Cannot register new client", "error", err)
+			conn.Close()
 			return
 		}
-		session, err := yamux.Client(conn, nil)
+		session, err := yamux.Client(&utils.BufferedConn{Conn: conn, Reader: bufrw.Reader}, config)
 		if err != nil {
-			http.Error(w, "Cannot init Yamux Client session", http.StatusInternalServerError)
-			log.Printf("Cannot init Yamux Client session: %s", err)
+			clientLog.Error("Cannot init Yamux Client session", "error", err)
+			conn.Close()
 			return
 		}
-		s.clientIn <- &Client{Conn: conn, Session: session, HTTPHost: r.Host}
+		weight, _ := strconv.Atoi(r.Header.Get(utils.WeightHeader))
+		client := &Client{
+			ID:          id,
+			Weight:      weight,
+			HealthPath:  r.Header.Get(utils.HealthPathHeader),
+			Version:     r.Header.Get(utils.ClientVersionHeader),
+			Conn:        conn,
+			Session:     session,
+			HTTPHosts:   hosts,
+			TCPPort:     reg.tcpPort,
+			UDPPort:     reg.udpPort,
+			ConnectedAt: time.Now(),
+			release:     release,
+			log:         clientLog,
+		}
+		registered = true
+		s.registry.Add(client)
+		go s.checkHealth(client)
+		go s.acceptClientStreams(client)
 	}
 	return h
 }
 
-func (s *Server) pickRandomClientStream(host string) (*yamux.Stream, error) {
-	for retry := 0; retry < 5; retry++ {
-		clientList, exists := s.clientList[host]
-		if !exists {
-			return nil, fmt.Errorf("Cannot handle request for Host %s: no Client registered for this Host", host)
+var (
+	// errNoClient is returned when no Client is registered for a Host
+	errNoClient = errors.New("No Client registered for this Host")
+	// errNoAvailableClient is returned when all the Clients of a Host are
+	// unhealthy or not ready
+	errNoAvailableClient = errors.New("No healthy and ready Client for this Host")
+	// errNoActiveClient is returned when no stream could be opened on the
+	// Clients of a Host
+	errNoActiveClient = errors.New("Cannot find a registered Client with an active connection")
+)
+
+// maxStreamRetries is the number of Clients tried to open a stream
+const maxStreamRetries = 5
+
+// lookupClients returns the Clients for a host and the registered host they
+// matched, or the Clients of the FallbackHost when no Client matches
+func (s *Server) lookupClients(host string) (string, []*Client) {
+	pattern, clientList := s.registry.Match(host)
+	if len(clientList) == 0 && s.FallbackHost != "" {
+		pattern, clientList = s.registry.Match(s.FallbackHost)
+	}
+	return pattern, clientList
+}
+
+// pickClientStream opens a stream on the Client the visitor is pinned to, or
+// on the Client chosen by the Balancer of the host, another Client is picked
+// if the stream cannot be opened. It also returns the registered host which
+// matched the request.
+func (s *Server) pickClientStream(w http.ResponseWriter, r *http.Request) (string, *countingConn, error) {
+	candidates := func() (string, []*Client, error) {
+		pattern, clientList := s.lookupClients(r.Host)
+		if len(clientList) == 0 {
+			return pattern, nil, errNoClient
+		}
+		if s.InMaintenance(pattern) {
+			return pattern, nil, errMaintenance
+		}
+		clientList = availableClients(clientList)
+		if len(clientList) == 0 {
+			return pattern, nil, errNoAvailableClient
+		}
+		return pattern, clientList, nil
+	}
+	pick := func(pattern string, clientList []*Client) *Client {
+		if client := s.pickAffinityClient(clientList, r); client != nil {
+			return client
+		}
+		return s.balancerFor(pattern).Pick(clientList, r)
+	}
+	pattern, stream, err := s.openStream(candidates, pick)
+	if err != nil {
+		return pattern, nil, err
+	}
+	s.setAffinityCookie(w, r, stream.client)
+	return pattern, stream, nil
+}
+
+// openStream opens a stream on the Client chosen by pick among the
+// candidates, which also return the host they are registered for. It is
+// retried with the new candidates when the stream cannot be opened (see
+// streamFailed).
+func (s *Server) openStream(candidates func() (string, []*Client, error), pick func(string, []*Client) *Client) (string, *countingConn, error) {
+	host := ""
+	for retry := 0; retry < maxStreamRetries; retry++ {
+		var (
+			clients []*Client
+			err     error
+		)
+		host, clients, err = candidates()
+		if err != nil {
+			return host, nil, err
+		}
+		if retry > 0 {
+			s.metrics.retries.Inc(host)
 		}
-		// Pick a client randomly
-		idx := s.random.Intn(len(clientList))
-		client := clientList[idx]
+		client := pick(host, clients)
 		stream, err := client.Session.OpenStream()
 		if err != nil {
-			log.Printf("Cannot open a new Yamux stream on the Client session: %s", err)
-			s.clientOut <- client
+			s.streamFailed(client, host, err)
 			continue
 		}
-		return stream, nil
+		return host, &countingConn{Stream: stream, client: client}, nil
+	}
+	return host, nil, errNoActiveClient
+}
+
+// streamFailed handles the failure to open a stream on the session of a
+// Client. A Client which sent a GoAway is shutting down: it is only marked as
+// draining so that its in-flight streams complete. Any other error means the
+// session is dead and the Client is removed.
+func (s *Server) streamFailed(client *Client, host string, err error) {
+	if err == yamux.ErrRemoteGoAway {
+		if s.registry.Drain(client) {
+			client.log.Info("Client draining", "reason", "GoAway received")
+		}
+		return
+	}
+	client.log.Warn("Cannot open a new Yamux stream on the Client session", "host", host, "error", err)
+	s.metrics.openFailures.Inc(host)
+	if s.registry.Remove(client) {
+		client.Close()
 	}
-	return nil, fmt.Errorf("Cannot find a registered Client with an active connection")
 }
 
 // createPublicHTTPHandler returns the handler that manages the Public HTTP traffic
 func createPublicHTTPHandler(s *Server) func(http.ResponseWriter, *http.Request) {
-	h := func(w http.ResponseWriter, r *http.Request) {
-		// Pick a random client and open a new Yamux stream
-		stream, err := s.pickRandomClientStream(r.Host)
+	h := func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		w := &responseRecorder{ResponseWriter: rw}
+		// Pick a client and open a new Yamux stream
+		host, stream, err := s.pickClientStream(w, r)
+		code := http.StatusBadGateway
+		defer func() {
+			if code != http.StatusSwitchingProtocols {
+				// The upgraded connections are recorded by proxyUpgrade
+				s.metrics.observeRequest(host, code, start, stream)
+			}
+			s.logAccess(r, stream, code, w.written, start)
+		}()
+		if err == errNoClient {
+			code = http.StatusNotFound
+			writeErrorPage(w, code,
+				fmt.Sprintf("No service is registered for %s.", utils.NormalizeHost(r.Host)))
+			s.log.Info("Cannot handle request", "host", r.Host, "remote_addr", r.RemoteAddr, "error", err)
+			return
+		}
+		if err == errMaintenance {
+			code = http.StatusServiceUnavailable
+			writeErrorPage(w, code,
+				"The service is under maintenance, please try again later.")
+			return
+		}
+		if err == errNoAvailableClient {
+			code = http.StatusServiceUnavailable
+			writeErrorPage(w, code,
+				"The service is temporarily unavailable, please try again later.")
+			s.log.Warn("Cannot handle request", "host", host, "remote_addr", r.RemoteAddr, "error", err)
+			return
+		}
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("Cannot find a valid registered Client: %s", err)
+			writeErrorPage(w, code, "The service cannot be reached.")
+			s.log.Error("Cannot find a valid registered Client", "host", host, "remote_addr", r.RemoteAddr, "error", err)
 			return
 		}
 		defer stream.Close()
-		log.Printf("Found a valid client registered for Host %s", r.Host)
-		// Got a valid client, hijack the connection
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-			log.Printf("Cannot handle request for Host %s: hijacking not supported", r.Host)
+		reqLog := stream.client.log.With("host", host, "stream_id", stream.StreamID(), "remote_addr", r.RemoteAddr)
+		var resp *http.Response
+		if upgradeProtocol(r.Header) != "" {
+			resp, err = s.proxyUpgrade(reqLog, w, r, host, stream, start)
+		} else {
+			resp, err = proxyRequest(reqLog, w, s.outgoingRequest(r), stream)
+		}
+		if err == errHijackFailed {
+			// Logged by proxyUpgrade, the visitor connection is unusable
+			return
+		}
+		if err == errUpgradeShutdown {
+			code = http.StatusServiceUnavailable
+			writeErrorPage(w, code,
+				"The service is temporarily unavailable, please try again later.")
 			return
 		}
-		conn, _, err := hj.Hijack()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Printf("Cannot handle request for Host %s: %s", r.Host, err)
+			writeErrorPage(w, code, "The service did not send a valid response.")
+			reqLog.Error("Cannot proxy request", "error", err)
 			return
 		}
-		// Send the initial request to the client
-		r.Write(stream)
-		utils.TunnelConn(conn, stream, true)
+		code = resp.StatusCode
+		reqLog.Info("Request proxied", "method", r.Method, "uri", r.URL.RequestURI(), "status", resp.StatusCode,
+			"bytes", w.written, "duration", time.Since(start))
 	}
 	return h
 }
 
-// StartServer creates an HTTP(s) server
+// StartServer creates an HTTP(s) server, it returns nil once stopped by
+// Shutdown
 func (s *Server) StartServer(address string, clientsManager bool, tlsConfig *TLSConfig) error {
 	mux := http.NewServeMux()
 	if clientsManager == true {
-		// Start the routine to manage the clients (in & out)
-		go s.manageClientList()
 		// Register the route to manage the SkyProxy cients
 		mux.HandleFunc("/_skyproxy/register", createClientsHTTPHandler(s))
 	} else {
 		// Register the route to handle the public HTTP(s) traffic
 		mux.HandleFunc("/", createPublicHTTPHandler(s))
 	}
+	return s.serve(&http.Server{Addr: address, Handler: mux}, tlsConfig)
+}
+
+// StartAdminServer creates the HTTP server of the admin API and of the
+// metrics, it should only listen on a private address
+func (s *Server) StartAdminServer(address string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.registry.Handler())
+	mux.HandleFunc("/", createAdminHTTPHandler(s))
+	return s.serve(&http.Server{Addr: address, Handler: mux}, nil)
+}
+
+// serve runs an HTTP(s) server until Shutdown is called
+func (s *Server) serve(server *http.Server, tlsConfig *TLSConfig) error {
+	if !s.addHTTPServer(server) {
+		return nil
+	}
+	var err error
 	if tlsConfig != nil {
-		return http.ListenAndServeTLS(address, tlsConfig.CertFile, tlsConfig.KeyFile, mux)
+		if tlsConfig.ClientCAFile != "" {
+			pool, err := loadCertPool(tlsConfig.ClientCAFile)
+			if err != nil {
+				return err
+			}
+			server.TLSConfig = &tls.Config{
+				ClientCAs:  pool,
+				ClientAuth: tls.RequireAndVerifyClientCert,
+			}
+		}
+		err = server.ListenAndServeTLS(tlsConfig.CertFile, tlsConfig.KeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err == http.ErrServerClosed {
+		// Stopped by Shutdown
+		return nil
+	}
+	return err
+}
+
+// loadCertPool reads the PEM certificates of a file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	certData, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if ok := pool.AppendCertsFromPEM(certData); ok != true {
+		return nil, fmt.Errorf("Cannot parse CA certificate file %s", path)
 	}
-	return http.ListenAndServe(address, mux)
+	return pool, nil
 }
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/samalba/skyproxy/control"
+)
+
+// DefaultShutdownTimeout is the maximum time given to the in-flight requests
+// to complete on shutdown
+const DefaultShutdownTimeout = 30 * time.Second
+
+// shutdownState tracks the HTTP servers started by StartServer, and the
+// tunnels which are not part of an HTTP request
+type shutdownState struct {
+	lock         sync.Mutex
+	shuttingDown bool
+	httpServers  []*http.Server
+	listeners    []net.Listener
+	tunnels      sync.WaitGroup
+}
+
+// addHTTPServer registers an HTTP server to stop on shutdown, it returns false
+// if the shutdown already started
+func (s *Server) addHTTPServer(server *http.Server) bool {
+	s.shutdown.lock.Lock()
+	defer s.shutdown.lock.Unlock()
+	if s.shutdown.shuttingDown {
+		return false
+	}
+	s.shutdown.httpServers = append(s.shutdown.httpServers, server)
+	return true
+}
+
+// addListener registers a listener to close on shutdown, it returns false if
+// the shutdown already started
+func (s *Server) addListener(listener net.Listener) bool {
+	s.shutdown.lock.Lock()
+	defer s.shutdown.lock.Unlock()
+	if s.shutdown.shuttingDown {
+		return false
+	}
+	s.shutdown.listeners = append(s.shutdown.listeners, listener)
+	return true
+}
+
+// startTunnel registers a tunnel to wait for on shutdown, it returns false if
+// the shutdown already started. tunnelDone must be called once it is closed.
+func (s *Server) startTunnel() bool {
+	s.shutdown.lock.Lock()
+	defer s.shutdown.lock.Unlock()
+	if s.shutdown.shuttingDown {
+		return false
+	}
+	s.shutdown.tunnels.Add(1)
+	return true
+}
+
+func (s *Server) tunnelDone() {
+	s.shutdown.tunnels.Done()
+}
+
+func (s *Server) isShuttingDown() bool {
+	s.shutdown.lock.Lock()
+	defer s.shutdown.lock.Unlock()
+	return s.shutdown.shuttingDown
+}
+
+// setDraining records that the Client stops accepting new streams, it is then
+// excluded from the selection. It returns false if the Client was already
+// draining.
+func (c *Client) setDraining() bool {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	if c.health.draining {
+		return false
+	}
+	c.health.draining = true
+	return true
+}
+
+// Draining returns true when the Client announced it is draining its session
+func (c *Client) Draining() bool {
+	c.health.lock.Lock()
+	defer c.health.lock.Unlock()
+	return c.health.draining
+}
+
+// Shutdown stops the server gracefully: the new registrations are refused,
+// the Clients are told the server is draining, the listeners are closed and
+// the in-flight requests and tunnels get up to timeout to complete. The Client
+// sessions are closed last.
+func (s *Server) Shutdown(timeout time.Duration) error {
+	s.shutdown.lock.Lock()
+	s.shutdown.shuttingDown = true
+	httpServers := s.shutdown.httpServers
+	listeners := s.shutdown.listeners
+	s.shutdown.lock.Unlock()
+	for _, listener := range listeners {
+		listener.Close()
+	}
+	s.closeTCPListeners()
+	s.closeUDPListeners()
+
+	clients := s.uniqueClients()
+	drain := &control.Drain{Reason: "Server shutting down", Timeout: int(timeout.Seconds())}
+	for _, client := range clients {
+		client.SendControl(control.TypeDrain, drain)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errLock  sync.Mutex
+		firstErr error
+	)
+	for _, server := range httpServers {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				s.log.Warn("Cannot stop the server gracefully", "address", server.Addr, "error", err)
+				server.Close()
+				errLock.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				errLock.Unlock()
+			}
+		}(server)
+	}
+	wg.Wait()
+	tunnelsDone := make(chan struct{})
+	go func() {
+		s.shutdown.tunnels.Wait()
+		close(tunnelsDone)
+	}()
+	select {
+	case <-tunnelsDone:
+	case <-ctx.Done():
+		s.log.Warn("Timeout reached while waiting for the tunnels, closing anyway", "timeout", timeout)
+	}
+
+	for _, client := range clients {
+		if s.registry.Remove(client) {
+			client.Close()
+		}
+	}
+	s.log.Info("Server stopped", "clients", len(clients))
+	return firstErr
+}
+
+// uniqueClients returns all the registered Clients, a Client registered for
+// several hosts is listed once
+func (s *Server) uniqueClients() []*Client {
+	clients := []*Client{}
+	seen := make(map[*Client]bool)
+	for _, l := range s.registry.List() {
+		for _, client := range l {
+			if !seen[client] {
+				seen[client] = true
+				clients = append(clients, client)
+			}
+		}
+	}
+	return clients
+}
@@ -0,0 +1,194 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/samalba/skyproxy/utils"
+)
+
+// tcpHostPrefix prefixes the port of the TCP Clients in the Registry, the
+// keys cannot collide with an HTTP host since the port of a Host header is
+// removed before the lookup
+const tcpHostPrefix = "tcp:"
+
+// errNoTCPPort is returned when all the ports of the range are used
+var errNoTCPPort = errors.New("No TCP port available")
+
+// tcpHost returns the Registry key of the Clients of a TCP port
+func tcpHost(port int) string {
+	return tcpHostPrefix + strconv.Itoa(port)
+}
+
+// tcpListener accepts the connections of a TCP port, it is shared by all the
+// Clients registered for this port
+type tcpListener struct {
+	listener net.Listener
+	port     int
+	clients  int
+}
+
+// tcpState holds the TCP listeners by port
+type tcpState struct {
+	lock      sync.Mutex
+	listeners map[int]*tcpListener
+}
+
+// TCPEnabled returns true if the Clients can register TCP ports
+func (s *Server) TCPEnabled() bool {
+	return s.TCPPortMin > 0 && s.TCPPortMax >= s.TCPPortMin
+}
+
+// validTCPPort checks a port requested by a Client, 0 asks the server to
+// assign a port
+func (s *Server) validTCPPort(port int) bool {
+	return port == 0 || (port >= s.TCPPortMin && port <= s.TCPPortMax)
+}
+
+// reserveTCPPort opens the listener of a port for a Client, or shares it if
+// other Clients are registered for the same port. Port 0 reserves the first
+// free port of the range. The returned function releases the port.
+func (s *Server) reserveTCPPort(port int) (int, func(), error) {
+	s.tcp.lock.Lock()
+	defer s.tcp.lock.Unlock()
+	if s.tcp.listeners == nil {
+		s.tcp.listeners = make(map[int]*tcpListener)
+	}
+	if port == 0 {
+		for p := s.TCPPortMin; p <= s.TCPPortMax; p++ {
+			if _, used := s.tcp.listeners[p]; used {
+				continue
+			}
+			if err := s.listenTCP(p); err == nil {
+				port = p
+				break
+			}
+		}
+		if port == 0 {
+			return 0, nil, errNoTCPPort
+		}
+	} else if l, exists := s.tcp.listeners[port]; exists {
+		l.clients++
+	} else if err := s.listenTCP(port); err != nil {
+		return 0, nil, err
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() { s.releaseTCPPort(port) })
+	}
+	return port, release, nil
+}
+
+// listenTCP must be called with the lock held
+func (s *Server) listenTCP(port int) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.TCPAddress, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("Cannot listen on TCP port %d: %s", port, err)
+	}
+	l := &tcpListener{listener: listener, port: port, clients: 1}
+	s.tcp.listeners[port] = l
+	s.log.Info("Listening on TCP port", "host", tcpHost(port), "address", listener.Addr().String())
+	go s.acceptTCP(l)
+	return nil
+}
+
+// releaseTCPPort closes the listener of a port once no Client is registered
+// for it
+func (s *Server) releaseTCPPort(port int) {
+	s.tcp.lock.Lock()
+	defer s.tcp.lock.Unlock()
+	l, exists := s.tcp.listeners[port]
+	if !exists {
+		return
+	}
+	l.clients--
+	if l.clients > 0 {
+		return
+	}
+	delete(s.tcp.listeners, port)
+	l.listener.Close()
+	s.log.Info("Closed TCP port", "host", tcpHost(port))
+}
+
+func (s *Server) acceptTCP(l *tcpListener) {
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			return
+		}
+		if !s.startTunnel() {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.tunnelDone()
+			s.forwardConn(tcpHost(l.port), conn, nil)
+		}()
+	}
+}
+
+// closeTCPListeners stops accepting the connections of all the TCP ports on
+// shutdown, the ports are released with the Client sessions
+func (s *Server) closeTCPListeners() {
+	s.tcp.lock.Lock()
+	defer s.tcp.lock.Unlock()
+	for _, l := range s.tcp.listeners {
+		l.listener.Close()
+	}
+}
+
+// openPassthroughStream opens a stream on one of the Clients registered for a
+// Registry key, another Client is picked if the stream cannot be opened
+func (s *Server) openPassthroughStream(host string, r *http.Request) (*countingConn, error) {
+	candidates := func() (string, []*Client, error) {
+		if s.InMaintenance(host) {
+			return host, nil, errMaintenance
+		}
+		clients := availableClients(s.registry.Get(host))
+		if len(clients) == 0 {
+			return host, nil, errNoAvailableClient
+		}
+		return host, clients, nil
+	}
+	pick := func(host string, clients []*Client) *Client {
+		return s.balancerFor(host).Pick(clients, r)
+	}
+	_, stream, err := s.openStream(candidates, pick)
+	return stream, err
+}
+
+// forwardConn tunnels a connection through a stream of one of the Clients
+// registered for a Registry key, head is written first to the stream
+func (s *Server) forwardConn(host string, conn net.Conn, head []byte) {
+	start := time.Now()
+	r := passthroughRequest(conn.RemoteAddr().String())
+	cc, err := s.openPassthroughStream(host, r)
+	if err != nil {
+		s.log.Warn("Cannot handle connection", "host", host, "remote_addr", r.RemoteAddr, "error", err)
+		conn.Close()
+		return
+	}
+	s.metrics.tcpConnections.Inc(host)
+	if len(head) > 0 {
+		if _, err := cc.Write(head); err != nil {
+			cc.client.log.Warn("Cannot write to the stream", "host", host, "error", err)
+			cc.Close()
+			conn.Close()
+			return
+		}
+	}
+	utils.TunnelConn(conn, cc, true)
+	s.metrics.observeTunnel(host, cc)
+	cc.client.log.Debug("Connection closed", "host", host, "stream_id", cc.StreamID(),
+		"remote_addr", r.RemoteAddr, "bytes_in", cc.bytesIn, "bytes", cc.bytesOut,
+		"duration", time.Since(start))
+}
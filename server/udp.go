@@ -0,0 +1,264 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/samalba/skyproxy/utils"
+)
+
+// udpHostPrefix prefixes the port of the UDP Clients in the Registry
+const udpHostPrefix = "udp:"
+
+// DefaultUDPIdleTimeout is the time after which a UDP flow without traffic is
+// closed when Server.UDPIdleTimeout is not set
+const DefaultUDPIdleTimeout = 60 * time.Second
+
+// udpFlowQueueSize is the number of datagrams queued for each flow, the next
+// ones are dropped until the stream catches up
+const udpFlowQueueSize = 64
+
+// errNoUDPPort is returned when all the ports of the range are used
+var errNoUDPPort = errors.New("No UDP port available")
+
+// udpHost returns the Registry key of the Clients of a UDP port
+func udpHost(port int) string {
+	return udpHostPrefix + strconv.Itoa(port)
+}
+
+// udpFlow tunnels the datagrams of a source address through a stream
+type udpFlow struct {
+	// datagrams are queued by readUDP and written to the stream by
+	// forwardUDP, done is closed once the flow ended
+	datagrams chan []byte
+	done      chan struct{}
+	stream    *countingConn
+	timer     *time.Timer
+	start     time.Time
+}
+
+// udpListener reads the datagrams of a UDP port, it is shared by all the
+// Clients registered for this port
+type udpListener struct {
+	conn    *net.UDPConn
+	port    int
+	clients int
+	lock    sync.Mutex
+	flows   map[string]*udpFlow
+}
+
+// udpState holds the UDP listeners by port
+type udpState struct {
+	lock      sync.Mutex
+	listeners map[int]*udpListener
+}
+
+// UDPEnabled returns true if the Clients can register UDP ports
+func (s *Server) UDPEnabled() bool {
+	return s.UDPPortMin > 0 && s.UDPPortMax >= s.UDPPortMin
+}
+
+// validUDPPort checks a port requested by a Client, 0 asks the server to
+// assign a port
+func (s *Server) validUDPPort(port int) bool {
+	return port == 0 || (port >= s.UDPPortMin && port <= s.UDPPortMax)
+}
+
+func (s *Server) udpIdleTimeout() time.Duration {
+	if s.UDPIdleTimeout > 0 {
+		return s.UDPIdleTimeout
+	}
+	return DefaultUDPIdleTimeout
+}
+
+// reserveUDPPort binds a port for a Client, or shares it if other Clients are
+// registered for the same port. Port 0 reserves the first free port of the
+// range. The returned function releases the port.
+func (s *Server) reserveUDPPort(port int) (int, func(), error) {
+	s.udp.lock.Lock()
+	defer s.udp.lock.Unlock()
+	if s.udp.listeners == nil {
+		s.udp.listeners = make(map[int]*udpListener)
+	}
+	if port == 0 {
+		for p := s.UDPPortMin; p <= s.UDPPortMax; p++ {
+			if _, used := s.udp.listeners[p]; used {
+				continue
+			}
+			if err := s.listenUDP(p); err == nil {
+				port = p
+				break
+			}
+		}
+		if port == 0 {
+			return 0, nil, errNoUDPPort
+		}
+	} else if l, exists := s.udp.listeners[port]; exists {
+		l.clients++
+	} else if err := s.listenUDP(port); err != nil {
+		return 0, nil, err
+	}
+	var once sync.Once
+	release := func() {
+		once.Do(func() { s.releaseUDPPort(port) })
+	}
+	return port, release, nil
+}
+
+// listenUDP must be called with the lock held
+func (s *Server) listenUDP(port int) error {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(s.UDPAddress, strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("Cannot listen on UDP port %d: %s", port, err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return fmt.Errorf("Cannot listen on UDP port %d: %s", port, err)
+	}
+	l := &udpListener{conn: conn, port: port, clients: 1, flows: make(map[string]*udpFlow)}
+	s.udp.listeners[port] = l
+	s.log.Info("Listening on UDP port", "host", udpHost(port), "address", conn.LocalAddr().String())
+	go s.readUDP(l)
+	return nil
+}
+
+// releaseUDPPort closes the socket of a port once no Client is registered for
+// it, the flows are closed with the Client sessions
+func (s *Server) releaseUDPPort(port int) {
+	s.udp.lock.Lock()
+	defer s.udp.lock.Unlock()
+	l, exists := s.udp.listeners[port]
+	if !exists {
+		return
+	}
+	l.clients--
+	if l.clients > 0 {
+		return
+	}
+	delete(s.udp.listeners, port)
+	l.conn.Close()
+	s.log.Info("Closed UDP port", "host", udpHost(port))
+}
+
+// closeUDPListeners closes the sockets of all the UDP ports on shutdown, a
+// UDP flow has no end to wait for
+func (s *Server) closeUDPListeners() {
+	s.udp.lock.Lock()
+	defer s.udp.lock.Unlock()
+	for _, l := range s.udp.listeners {
+		l.conn.Close()
+	}
+}
+
+// readUDP queues the datagrams received on a port to the flow of their
+// source address, the datagrams are dropped when the queue of the flow is
+// full so that a slow stream does not delay the other flows
+func (s *Server) readUDP(l *udpListener) {
+	host := udpHost(l.port)
+	buf := make([]byte, utils.MaxDatagramSize)
+	for {
+		n, addr, err := l.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		flow := s.udpFlow(l, addr)
+		select {
+		case flow.datagrams <- append([]byte(nil), buf[:n]...):
+		default:
+			s.log.Debug("Dropped UDP datagram", "host", host, "remote_addr", addr.String(), "error", "Flow queue full")
+		}
+	}
+}
+
+// udpFlow returns the flow of a source address, a new flow is started for a
+// new source address
+func (s *Server) udpFlow(l *udpListener, addr *net.UDPAddr) *udpFlow {
+	key := addr.String()
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if flow, exists := l.flows[key]; exists {
+		return flow
+	}
+	flow := &udpFlow{
+		datagrams: make(chan []byte, udpFlowQueueSize),
+		done:      make(chan struct{}),
+		start:     time.Now(),
+	}
+	l.flows[key] = flow
+	go s.forwardUDP(l, addr, flow)
+	return flow
+}
+
+// endUDPFlow removes a flow from its listener
+func (s *Server) endUDPFlow(l *udpListener, addr *net.UDPAddr, flow *udpFlow) {
+	close(flow.done)
+	l.lock.Lock()
+	if l.flows[addr.String()] == flow {
+		delete(l.flows, addr.String())
+	}
+	l.lock.Unlock()
+}
+
+// forwardUDP opens the stream of a flow on one of the Clients, then writes the
+// queued datagrams to it until the flow ends
+func (s *Server) forwardUDP(l *udpListener, addr *net.UDPAddr, flow *udpFlow) {
+	key := addr.String()
+	host := udpHost(l.port)
+	stream, err := s.openPassthroughStream(host, passthroughRequest(key))
+	if err != nil {
+		s.log.Debug("Dropped UDP datagram", "host", host, "remote_addr", key, "error", err)
+		s.endUDPFlow(l, addr, flow)
+		return
+	}
+	// The Client receives the source address first
+	if err := utils.WriteDatagram(stream, []byte(key)); err != nil {
+		stream.Close()
+		s.endUDPFlow(l, addr, flow)
+		return
+	}
+	flow.stream = stream
+	// Closing the stream ends the flow
+	flow.timer = time.AfterFunc(s.udpIdleTimeout(), func() { stream.Close() })
+	s.metrics.udpFlows.Inc(host)
+	go s.replyUDP(l, addr, flow)
+	for {
+		select {
+		case datagram := <-flow.datagrams:
+			flow.timer.Reset(s.udpIdleTimeout())
+			if err := utils.WriteDatagram(stream, datagram); err != nil {
+				stream.Close()
+			}
+		case <-flow.done:
+			return
+		}
+	}
+}
+
+// replyUDP sends the datagrams of a flow stream back to the source address,
+// until the stream is closed
+func (s *Server) replyUDP(l *udpListener, addr *net.UDPAddr, flow *udpFlow) {
+	buf := make([]byte, utils.MaxDatagramSize)
+	for {
+		n, err := utils.ReadDatagram(flow.stream, buf)
+		if err != nil {
+			break
+		}
+		flow.timer.Reset(s.udpIdleTimeout())
+		l.conn.WriteToUDP(buf[:n], addr)
+	}
+	flow.timer.Stop()
+	flow.stream.Close()
+	s.endUDPFlow(l, addr, flow)
+	host := udpHost(l.port)
+	s.metrics.observeTunnel(host, flow.stream)
+	flow.stream.client.log.Debug("UDP flow closed", "host", host, "stream_id", flow.stream.StreamID(),
+		"remote_addr", addr.String(), "bytes_in", flow.stream.bytesIn, "bytes", flow.stream.bytesOut,
+		"duration", time.Since(flow.start))
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/samalba/skyproxy/logging"
+	"github.com/samalba/skyproxy/utils"
+)
+
+// DefaultUpgradeIdleTimeout is the time after which an upgraded connection
+// without traffic is closed when Server.UpgradeIdleTimeout is not set
+const DefaultUpgradeIdleTimeout = 5 * time.Minute
+
+// errHijackFailed is returned by proxyUpgrade when the visitor connection
+// cannot be taken over, no response can be written to the visitor then
+var errHijackFailed = errors.New("Cannot hijack the visitor connection")
+
+// errUpgradeShutdown is returned by proxyUpgrade when the server is shutting
+// down, a new upgraded connection would not be waited for
+var errUpgradeShutdown = errors.New("Server shutting down")
+
+func (s *Server) upgradeIdleTimeout() time.Duration {
+	if s.UpgradeIdleTimeout > 0 {
+		return s.UpgradeIdleTimeout
+	}
+	return DefaultUpgradeIdleTimeout
+}
+
+// proxyUpgrade forwards an Upgrade request (WebSocket...) on the stream. If
+// the receiver switches protocols, the 101 response is sent back and the
+// visitor connection is tunneled as is to the stream until one of them is
+// closed or idle. Otherwise the response is sent back like any other. As for
+// proxyRequest, the returned error is set only if nothing has been written
+// to the visitor yet. The shutdown waits for the upgraded connections like for
+// the TCP tunnels.
+func (s *Server) proxyUpgrade(log logging.Logger, w *responseRecorder, r *http.Request, host string,
+	stream *countingConn, start time.Time) (*http.Response, error) {
+	if !s.startTunnel() {
+		return nil, errUpgradeShutdown
+	}
+	defer s.tunnelDone()
+	outReq := s.outgoingRequest(r)
+	if err := outReq.Write(stream); err != nil {
+		return nil, err
+	}
+	streamReader := bufio.NewReader(stream)
+	resp, err := http.ReadResponse(streamReader, outReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// The receiver refused the upgrade
+		writeResponse(log, w, resp)
+		return resp, nil
+	}
+	// The headers set by the server (the affinity cookie...) are lost once
+	// the connection is hijacked
+	header := w.Header()
+	conn, visitorBuf, err := w.Hijack()
+	if err != nil {
+		log.Error("Cannot hijack the visitor connection", "error", err)
+		return nil, errHijackFailed
+	}
+	protocol := resp.Header.Get("Upgrade")
+	removeHopHeaders(resp.Header)
+	for name, values := range header {
+		for _, value := range values {
+			resp.Header.Add(name, value)
+		}
+	}
+	resp.Header.Set("Connection", "Upgrade")
+	resp.Header.Set("Upgrade", protocol)
+	visitorBuf.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	resp.Header.Write(visitorBuf)
+	visitorBuf.WriteString("\r\n")
+	err = visitorBuf.Flush()
+	// The time to switch protocols is recorded as the request duration, the
+	// lifetime of the connection by the upgrade metrics
+	s.metrics.observeRequest(host, resp.StatusCode, start, nil)
+	if err != nil {
+		log.Warn("Cannot send the response back", "error", err)
+		conn.Close()
+		return resp, nil
+	}
+	protocol = strings.ToLower(protocol)
+	s.metrics.upgradeStarted(host, protocol)
+	upgradeStart := time.Now()
+	// Both sides might have buffered data already
+	written, _, timedOut := utils.TunnelConnTimeout(
+		&utils.BufferedConn{Conn: conn, Reader: visitorBuf.Reader},
+		&utils.BufferedConn{Conn: stream, Reader: streamReader},
+		s.upgradeIdleTimeout())
+	w.written = written
+	s.metrics.upgradeDone(host, upgradeStart, timedOut)
+	s.metrics.observeTunnel(host, stream)
+	log.Debug("Upgraded connection closed", "protocol", protocol, "bytes_in", stream.bytesIn,
+		"bytes", written, "duration", time.Since(upgradeStart), "idle_timeout", timedOut)
+	return resp, nil
+}
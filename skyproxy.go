@@ -2,12 +2,17 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 
 	"github.com/samalba/skyproxy/client"
+	"github.com/samalba/skyproxy/logging"
 	"github.com/samalba/skyproxy/server"
+	"github.com/samalba/skyproxy/utils"
 
 	"github.com/codegangsta/cli"
 )
@@ -72,7 +77,7 @@ func globalCommands() []cli.Command {
 			Usage:  "Start a server",
 			Action: runServer,
 			Before: func(c *cli.Context) error {
-				if err := requireArgs(c, cliOneArg, []string{"proxy-http", "proxy-https"}); err != nil {
+				if err := requireArgs(c, cliOneArg, []string{"proxy-http", "proxy-https", "proxy-tls-passthrough"}); err != nil {
 					return err
 				}
 				if err := requireArgs(c, cliOneIfFirstArg, []string{"proxy-http", "clients-http", "clients-https"}); err != nil {
@@ -81,12 +86,25 @@ func globalCommands() []cli.Command {
 				if err := requireArgs(c, cliOneIfFirstArg, []string{"proxy-https", "clients-http", "clients-https"}); err != nil {
 					return err
 				}
+				if err := requireArgs(c, cliOneIfFirstArg, []string{"proxy-tls-passthrough", "clients-http", "clients-https"}); err != nil {
+					return err
+				}
 				if err := requireArgs(c, cliAllIfFirstArg, []string{"proxy-https", "proxy-tls-cert", "proxy-tls-key"}); err != nil {
 					return err
 				}
 				if err := requireArgs(c, cliAllIfFirstArg, []string{"clients-https", "clients-tls-cert", "clients-tls-key"}); err != nil {
 					return err
 				}
+				if err := requireArgs(c, cliAllIfFirstArg, []string{"clients-tls-ca", "clients-https"}); err != nil {
+					return err
+				}
+				if err := requireArgs(c, cliAllIfFirstArg, []string{"clients-tls-identities", "clients-tls-ca"}); err != nil {
+					return err
+				}
+				if c.String("clients-tls-ca") != "" && c.String("clients-http") != "" {
+					fmt.Println("The argument \"--clients-http\" cannot be used with \"--clients-tls-ca\", the clients would register without a certificate")
+					os.Exit(1)
+				}
 				return nil
 			},
 			Flags: []cli.Flag{
@@ -100,6 +118,11 @@ func globalCommands() []cli.Command {
 					Value: "",
 					Usage: "HTTPs proxy address to listen on (ex: \":443\")",
 				},
+				cli.StringFlag{
+					Name:  "proxy-tls-passthrough",
+					Value: "",
+					Usage: "Address to listen on for the TLS connections forwarded as is to the clients by their SNI server name (ex: \":8443\")",
+				},
 				cli.StringFlag{
 					Name:  "proxy-tls-cert",
 					Value: "",
@@ -130,6 +153,116 @@ func globalCommands() []cli.Command {
 					Value: "",
 					Usage: "TLS Key file (use with --clients-https)",
 				},
+				cli.StringFlag{
+					Name:  "clients-tls-ca",
+					Value: "",
+					Usage: "TLS CA Certificate file to verify the clients certificates (use with --clients-https)",
+				},
+				cli.StringFlag{
+					Name:  "clients-tls-identities",
+					Value: "",
+					Usage: "File listing the host patterns allowed for each client certificate name (use with --clients-tls-ca)",
+				},
+				cli.StringFlag{
+					Name:  "fallback-host",
+					Value: "",
+					Usage: "Registered host receiving the requests for unknown hosts (ex: \"default.domain.tld\")",
+				},
+				cli.StringFlag{
+					Name:  "balancer",
+					Value: server.DefaultBalancer,
+					Usage: "Strategy to pick a client: random, round-robin, least-streams, weighted, hash-ip or hash-cookie:<name>",
+				},
+				cli.StringSliceFlag{
+					Name:  "host-balancer",
+					Value: &cli.StringSlice{},
+					Usage: "Strategy to pick a client for a registered host, can be repeated (ex: \"api.domain.tld=round-robin\")",
+				},
+				cli.StringFlag{
+					Name:  "affinity",
+					Value: "",
+					Usage: "Pin each visitor to a client: \"cookie\" (set by the server) or \"ip\" (disabled by default)",
+				},
+				cli.StringFlag{
+					Name:  "affinity-cookie",
+					Value: server.DefaultAffinityCookie,
+					Usage: "Name of the affinity cookie (use with --affinity cookie)",
+				},
+				cli.DurationFlag{
+					Name:  "health-interval",
+					Value: server.DefaultHealthInterval,
+					Usage: "Interval between two health checks of each client",
+				},
+				cli.DurationFlag{
+					Name:  "health-timeout",
+					Value: server.DefaultHealthTimeout,
+					Usage: "Timeout of a client health check",
+				},
+				cli.StringFlag{
+					Name:  "log-level",
+					Value: "info",
+					Usage: "Minimum level of the logs: debug, info, warn or error",
+				},
+				cli.StringFlag{
+					Name:  "log-format",
+					Value: logging.FormatLogfmt,
+					Usage: "Format of the logs: logfmt or json",
+				},
+				cli.DurationFlag{
+					Name:  "shutdown-timeout",
+					Value: server.DefaultShutdownTimeout,
+					Usage: "Maximum time given to the in-flight requests to complete on SIGINT/SIGTERM",
+				},
+				cli.DurationFlag{
+					Name:  "upgrade-idle-timeout",
+					Value: server.DefaultUpgradeIdleTimeout,
+					Usage: "Time after which an upgraded connection (WebSocket...) without traffic is closed",
+				},
+				cli.StringFlag{
+					Name:  "tcp-ports",
+					Value: "",
+					Usage: "Range of the TCP ports the clients can register (ex: \"20000-20100\"), TCP tunnels are disabled by default",
+				},
+				cli.StringFlag{
+					Name:  "tcp-address",
+					Value: "",
+					Usage: "Address the TCP ports listen on (all the interfaces by default)",
+				},
+				cli.StringFlag{
+					Name:  "udp-ports",
+					Value: "",
+					Usage: "Range of the UDP ports the clients can register (ex: \"21000-21100\"), UDP tunnels are disabled by default",
+				},
+				cli.StringFlag{
+					Name:  "udp-address",
+					Value: "",
+					Usage: "Address the UDP ports listen on (all the interfaces by default)",
+				},
+				cli.DurationFlag{
+					Name:  "udp-idle-timeout",
+					Value: server.DefaultUDPIdleTimeout,
+					Usage: "Time after which a UDP flow without traffic is closed",
+				},
+				cli.StringFlag{
+					Name:  "access-log",
+					Value: "",
+					Usage: "File receiving an entry per public request, \"-\" for stdout, reopened on SIGHUP (disabled by default)",
+				},
+				cli.StringFlag{
+					Name:  "access-log-format",
+					Value: server.AccessLogCombined,
+					Usage: "Format of the access log: combined, json or a Go template (ex: \"{{.Host}} {{.Status}}\")",
+				},
+				cli.StringFlag{
+					Name:  "admin-http",
+					Value: "",
+					Usage: "Address of the admin API and of the Prometheus metrics (ex: \"127.0.0.1:1090\"), disabled by default",
+				},
+				cli.StringFlag{
+					Name:  "clients-tokens-file",
+					Value: "",
+					Usage: "File listing the tokens allowed to register clients and their host patterns (disabled by default)",
+				},
 			},
 		},
 		{
@@ -137,7 +270,24 @@ func globalCommands() []cli.Command {
 			Usage:  "Connects to a local receiver",
 			Action: runClient,
 			Before: func(c *cli.Context) error {
-				return requireArgs(c, cliAllArgs, []string{"server", "receiver", "http-host"})
+				if c.String("tcp-port") != "" || c.String("udp-port") != "" {
+					if err := requireArgs(c, cliAllArgs, []string{"server", "receiver"}); err != nil {
+						return err
+					}
+				} else if err := requireArgs(c, cliAllArgs, []string{"server", "http-host"}); err != nil {
+					return err
+				}
+				if c.String("receiver") == "" && c.String("routes-file") == "" && len(c.StringSlice("route")) == 0 {
+					// Without default receiver, all the hosts must be mapped to
+					// their own one ("host=receiver")
+					hosts, routes := parseHTTPHosts(c.String("http-host"))
+					if len(hosts) == 0 || len(routes) != len(hosts) {
+						fmt.Println("You need to specify one of the following arguments: --receiver, --route, --routes-file, " +
+							"or a receiver for each --http-host (ex: \"www.example.com=localhost:8080\")")
+						os.Exit(1)
+					}
+				}
+				return requireArgs(c, cliAllIfFirstArg, []string{"tls-cert", "tls-key"})
 			},
 			Flags: []cli.Flag{
 				cli.StringFlag{
@@ -150,44 +300,259 @@ func globalCommands() []cli.Command {
 					Value: "",
 					Usage: "Local HTTP receiver to direct the traffic to (ex: localhost:8080)",
 				},
+				cli.StringSliceFlag{
+					Name:  "route",
+					Value: &cli.StringSlice{},
+					Usage: "Route the requests to a receiver by Host and/or path prefix, can be repeated (ex: \"/api=localhost:8080\")",
+				},
+				cli.StringFlag{
+					Name:  "routes-file",
+					Value: "",
+					Usage: "File listing the routes, one per line",
+				},
 				cli.StringFlag{
 					Name:  "http-host",
 					Value: "",
-					Usage: "HTTP host to announce (ex: my.website.tld)",
+					Usage: "HTTP hosts to announce, separated by commas, each one optionally followed by its own receiver (ex: my.website.tld,api.website.tld=localhost:8081)",
+				},
+				cli.StringFlag{
+					Name:  "tcp-port",
+					Value: "",
+					Usage: "Tunnels a TCP port of the server instead of HTTP hosts, \"auto\" lets the server assign the port",
+				},
+				cli.StringFlag{
+					Name:  "udp-port",
+					Value: "",
+					Usage: "Tunnels the datagrams of a UDP port of the server to a UDP receiver, \"auto\" lets the server assign the port",
+				},
+				cli.DurationFlag{
+					Name:  "udp-idle-timeout",
+					Value: client.DefaultUDPIdleTimeout,
+					Usage: "Time after which a UDP flow without traffic is closed",
+				},
+				cli.BoolFlag{
+					Name:  "tls-passthrough",
+					Usage: "Receives the TLS connections for the HTTP hosts without the server terminating them, the receiver must serve TLS",
 				},
 				cli.StringFlag{
 					Name:  "tls-ca",
 					Value: "",
 					Usage: "TLS CA Certificate file (disabled by default)",
 				},
+				cli.StringFlag{
+					Name:  "tls-cert",
+					Value: "",
+					Usage: "TLS client Certificate file (disabled by default)",
+				},
+				cli.StringFlag{
+					Name:  "tls-key",
+					Value: "",
+					Usage: "TLS client Key file (use with --tls-cert)",
+				},
+				cli.StringFlag{
+					Name:   "token",
+					Value:  "",
+					Usage:  "Token sent to the server to authorize the registration",
+					EnvVar: "SKYPROXY_TOKEN",
+				},
+				cli.IntFlag{
+					Name:  "weight",
+					Value: 1,
+					Usage: "Weight of the client when the server uses the weighted balancer",
+				},
+				cli.StringFlag{
+					Name:  "health-path",
+					Value: "",
+					Usage: "Path requested by the server to check the receiver health (ex: \"/healthz\")",
+				},
+				cli.DurationFlag{
+					Name:  "receiver-check-interval",
+					Value: client.DefaultReceiverCheckInterval,
+					Usage: "Interval between two checks of the receivers, their readiness is reported to the server",
+				},
+				cli.IntFlag{
+					Name:  "max-streams",
+					Value: client.DefaultMaxStreams,
+					Usage: "Maximum number of requests forwarded concurrently to the receiver",
+				},
+				cli.DurationFlag{
+					Name:  "retry-max-delay",
+					Value: client.DefaultMaxRetryDelay,
+					Usage: "Maximum delay between two reconnection attempts",
+				},
+				cli.StringFlag{
+					Name:  "metrics-http",
+					Value: "",
+					Usage: "Address exporting the Prometheus metrics on /metrics (ex: \"127.0.0.1:1091\"), disabled by default",
+				},
+				cli.StringFlag{
+					Name:  "log-level",
+					Value: "info",
+					Usage: "Minimum level of the logs: debug, info, warn or error",
+				},
+				cli.StringFlag{
+					Name:  "log-format",
+					Value: logging.FormatLogfmt,
+					Usage: "Format of the logs: logfmt or json",
+				},
+				cli.DurationFlag{
+					Name:  "shutdown-timeout",
+					Value: client.DefaultShutdownTimeout,
+					Usage: "Maximum time given to the in-flight streams to complete on SIGINT/SIGTERM",
+				},
 			},
 		},
 	}
 }
 
+// Parses the list of HTTP hosts of the client, each host can be mapped to its
+// own receiver with "host=receiver"
+func parseHTTPHosts(value string) ([]string, []client.Route) {
+	hosts := []string{}
+	routes := []client.Route{}
+	for _, host := range strings.Split(value, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if idx := strings.Index(host, "="); idx >= 0 {
+			routes = append(routes, client.Route{Host: host[:idx], Receiver: host[idx+1:]})
+			host = host[:idx]
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, routes
+}
+
+// newLogger creates the Logger configured by the command flags, all the lines
+// have a component field
+func newLogger(c *cli.Context, component string) logging.Logger {
+	level, err := logging.ParseLevel(c.String("log-level"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	logger, err := logging.New(os.Stderr, c.String("log-format"), level)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	return logger.With("component", component)
+}
+
+// fatal logs an error and exits
+func fatal(logger logging.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// Parses a range of ports, "min-max" or a single port
+func parsePortRange(value string) (int, int, error) {
+	bounds := strings.SplitN(value, "-", 2)
+	if len(bounds) == 1 {
+		bounds = append(bounds, bounds[0])
+	}
+	min, err1 := strconv.Atoi(strings.TrimSpace(bounds[0]))
+	max, err2 := strconv.Atoi(strings.TrimSpace(bounds[1]))
+	if err1 != nil || err2 != nil || min < 1 || max > 65535 || min > max {
+		return 0, 0, fmt.Errorf("Expected a range of ports such as \"20000-20100\", got %q", value)
+	}
+	return min, max, nil
+}
+
 func runClient(c *cli.Context) {
+	logger := newLogger(c, "client")
 	server := c.String("server")
 	receiver := c.String("receiver")
-	httpHost := c.String("http-host")
+	httpHosts, routes := parseHTTPHosts(c.String("http-host"))
+	if routesFile := c.String("routes-file"); routesFile != "" {
+		fileRoutes, err := client.LoadRouteFile(routesFile)
+		if err != nil {
+			fatal(logger, "Cannot load the routes", err)
+		}
+		routes = append(routes, fileRoutes...)
+	}
+	for _, value := range c.StringSlice("route") {
+		route, err := client.ParseRoute(value)
+		if err != nil {
+			fatal(logger, "Invalid route", err)
+		}
+		routes = append(routes, route)
+	}
 	tlsCA := c.String("tls-ca")
-	log.SetPrefix("[client] ")
-	log.Printf("Connecting to server: %s", server)
-	log.Printf("Registering HTTP Host: %s", httpHost)
-	skyClient := &client.Client{HTTPHost: httpHost}
-	if tlsCA != "" {
-		tlsConfig := &client.TLSConfig{
-			CAFile: tlsCA,
+	tlsCert := c.String("tls-cert")
+	logger.Info("Connecting to server", "server", server, "hosts", httpHosts)
+	skyClient := &client.Client{
+		HTTPHosts:             httpHosts,
+		Routes:                routes,
+		Token:                 c.String("token"),
+		Weight:                c.Int("weight"),
+		HealthPath:            c.String("health-path"),
+		ReceiverCheckInterval: c.Duration("receiver-check-interval"),
+		MaxStreams:            c.Int("max-streams"),
+		MaxRetryDelay:         c.Duration("retry-max-delay"),
+		Logger:                logger,
+	}
+	if c.Bool("tls-passthrough") {
+		skyClient.Mode = utils.ModeTLS
+	}
+	if tcpPort := c.String("tcp-port"); tcpPort != "" {
+		skyClient.Mode = utils.ModeTCP
+		if tcpPort != "auto" {
+			port, err := strconv.Atoi(tcpPort)
+			if err != nil || port < 0 || port > 65535 {
+				fatal(logger, "Invalid TCP port", fmt.Errorf("Expected a port or \"auto\", got %q", tcpPort))
+			}
+			skyClient.TCPPort = port
 		}
-		if err := skyClient.Connect(server, tlsConfig); err != nil {
-			log.Fatalf("Cannot connect: %s", err)
+	}
+	if udpPort := c.String("udp-port"); udpPort != "" {
+		skyClient.Mode = utils.ModeUDP
+		skyClient.UDPIdleTimeout = c.Duration("udp-idle-timeout")
+		if udpPort != "auto" {
+			port, err := strconv.Atoi(udpPort)
+			if err != nil || port < 0 || port > 65535 {
+				fatal(logger, "Invalid UDP port", fmt.Errorf("Expected a port or \"auto\", got %q", udpPort))
+			}
+			skyClient.UDPPort = port
 		}
-	} else {
-		if err := skyClient.Connect(server, nil); err != nil {
-			log.Fatalf("Cannot connect: %s", err)
+	}
+	var tlsConfig *client.TLSConfig
+	if tlsCA != "" || tlsCert != "" {
+		tlsConfig = &client.TLSConfig{
+			CAFile:   tlsCA,
+			CertFile: tlsCert,
+			KeyFile:  c.String("tls-key"),
 		}
 	}
-	log.Printf("Connection established, forwarding the traffic to: %s", receiver)
-	skyClient.Tunnel(receiver)
+	if receiver != "" {
+		logger.Info("Forwarding the traffic", "receiver", receiver)
+	}
+	for _, route := range routes {
+		logger.Info("Forwarding the traffic of a route", "route", route)
+	}
+	if metricsHTTP := c.String("metrics-http"); metricsHTTP != "" {
+		go func() {
+			logger.Info("Exporting the metrics", "address", metricsHTTP)
+			if err := skyClient.ServeMetrics(metricsHTTP); err != nil {
+				fatal(logger, "Cannot export the metrics", err)
+			}
+		}()
+	}
+	go func() {
+		// Drain the in-flight streams before exiting. SIGUSR1 is sent to an
+		// old client once its replacement is connected.
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM, syscall.SIGUSR1)
+		sig := <-sigChan
+		// A second signal kills the process without waiting for the streams
+		signal.Stop(sigChan)
+		logger.Info("Draining the streams", "signal", sig)
+		skyClient.Shutdown(c.Duration("shutdown-timeout"))
+	}()
+	if err := skyClient.Run(server, tlsConfig, receiver); err != nil {
+		fatal(logger, "Cannot connect", err)
+	}
 }
 
 func runServer(c *cli.Context) {
@@ -200,63 +565,179 @@ func runServer(c *cli.Context) {
 	clientsHTTPS := c.String("clients-https")
 	clientsTLSCert := c.String("clients-tls-cert")
 	clientsTLSKey := c.String("clients-tls-key")
-	log.SetPrefix("[server] ")
+	clientsTLSCA := c.String("clients-tls-ca")
+	logger := newLogger(c, "server")
 	serv := server.NewServer()
+	serv.SetLogger(logger)
+	serv.FallbackHost = c.String("fallback-host")
+	serv.HealthInterval = c.Duration("health-interval")
+	serv.HealthTimeout = c.Duration("health-timeout")
+	serv.UpgradeIdleTimeout = c.Duration("upgrade-idle-timeout")
+	if err := serv.SetAffinity(c.String("affinity"), c.String("affinity-cookie")); err != nil {
+		fatal(logger, "Invalid affinity", err)
+	}
+	if err := serv.SetBalancer("", c.String("balancer")); err != nil {
+		fatal(logger, "Invalid balancer", err)
+	}
+	for _, value := range c.StringSlice("host-balancer") {
+		idx := strings.Index(value, "=")
+		if idx <= 0 {
+			fatal(logger, "Invalid host balancer", fmt.Errorf("Expected host=strategy, got %q", value))
+		}
+		if err := serv.SetBalancer(value[:idx], value[idx+1:]); err != nil {
+			fatal(logger, "Invalid host balancer", err)
+		}
+	}
+	if tcpPorts := c.String("tcp-ports"); tcpPorts != "" {
+		min, max, err := parsePortRange(tcpPorts)
+		if err != nil {
+			fatal(logger, "Invalid TCP ports", err)
+		}
+		serv.TCPPortMin = min
+		serv.TCPPortMax = max
+		serv.TCPAddress = c.String("tcp-address")
+	}
+	if udpPorts := c.String("udp-ports"); udpPorts != "" {
+		min, max, err := parsePortRange(udpPorts)
+		if err != nil {
+			fatal(logger, "Invalid UDP ports", err)
+		}
+		serv.UDPPortMin = min
+		serv.UDPPortMax = max
+		serv.UDPAddress = c.String("udp-address")
+		serv.UDPIdleTimeout = c.Duration("udp-idle-timeout")
+	}
+	if accessLogPath := c.String("access-log"); accessLogPath != "" {
+		accessLog, err := server.NewAccessLog(accessLogPath, c.String("access-log-format"))
+		if err != nil {
+			fatal(logger, "Cannot open the access log", err)
+		}
+		defer accessLog.Close()
+		serv.AccessLog = accessLog
+		go func() {
+			// Reopen the access log after its rotation
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, syscall.SIGHUP)
+			for range sigChan {
+				if err := accessLog.Reopen(); err != nil {
+					logger.Error("Cannot reopen the access log", "error", err)
+				} else {
+					logger.Info("Access log reopened", "path", accessLogPath)
+				}
+			}
+		}()
+	}
+	if tokensFile := c.String("clients-tokens-file"); tokensFile != "" {
+		tokens, err := server.LoadTokenFile(tokensFile)
+		if err != nil {
+			fatal(logger, "Cannot load the tokens", err)
+		}
+		serv.Tokens = tokens
+	}
+	serv.RequireClientCert = clientsTLSCA != ""
+	if identitiesFile := c.String("clients-tls-identities"); identitiesFile != "" {
+		identities, err := server.LoadIdentityFile(identitiesFile)
+		if err != nil {
+			fatal(logger, "Cannot load the certificate identities", err)
+		}
+		serv.ClientCerts = identities
+	}
 	if proxyHTTPS != "" {
 		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			tlsConfig := &server.TLSConfig{
 				CertFile: proxyTLSCert,
 				KeyFile:  proxyTLSKey,
 			}
 			// Start the HTTPS proxy server
-			log.Printf("Starting HTTPS proxy server at %s", proxyHTTPS)
+			logger.Info("Starting HTTPS proxy server", "address", proxyHTTPS)
 			if err := serv.StartServer(proxyHTTPS, false, tlsConfig); err != nil {
-				log.Fatal(err)
+				fatal(logger, "Server stopped", err)
 			}
 		}()
 	}
 	if proxyHTTP != "" {
 		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			// Start the HTTP server
-			log.Printf("Starting HTTP proxy server at %s", proxyHTTP)
+			logger.Info("Starting HTTP proxy server", "address", proxyHTTP)
 			if err := serv.StartServer(proxyHTTP, false, nil); err != nil {
-				log.Fatal(err)
+				fatal(logger, "Server stopped", err)
 			}
 		}()
 	}
 	if clientsHTTPS != "" {
 		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			tlsConfig := &server.TLSConfig{
-				CertFile: clientsTLSCert,
-				KeyFile:  clientsTLSKey,
+				CertFile:     clientsTLSCert,
+				KeyFile:      clientsTLSKey,
+				ClientCAFile: clientsTLSCA,
 			}
 			// Start the HTTPS proxy server
-			log.Printf("Starting HTTPS clients server at %s", clientsHTTPS)
+			logger.Info("Starting HTTPS clients server", "address", clientsHTTPS)
 			if err := serv.StartServer(clientsHTTPS, true, tlsConfig); err != nil {
-				log.Fatal(err)
+				fatal(logger, "Server stopped", err)
 			}
 		}()
 	}
 	if clientsHTTP != "" {
 		wg.Add(1)
 		go func() {
+			defer wg.Done()
 			// Start the HTTP server
-			log.Printf("Starting HTTP clients server at %s", clientsHTTP)
+			logger.Info("Starting HTTP clients server", "address", clientsHTTP)
 			if err := serv.StartServer(clientsHTTP, true, nil); err != nil {
-				log.Fatal(err)
+				fatal(logger, "Server stopped", err)
+			}
+		}()
+	}
+	if proxyTLSPassthrough := c.String("proxy-tls-passthrough"); proxyTLSPassthrough != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Start the TLS passthrough server
+			logger.Info("Starting TLS passthrough server", "address", proxyTLSPassthrough)
+			if err := serv.StartPassthroughServer(proxyTLSPassthrough); err != nil {
+				fatal(logger, "Server stopped", err)
+			}
+		}()
+	}
+	if adminHTTP := c.String("admin-http"); adminHTTP != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Start the admin API server
+			logger.Info("Starting HTTP admin server", "address", adminHTTP)
+			if err := serv.StartAdminServer(adminHTTP); err != nil {
+				fatal(logger, "Server stopped", err)
 			}
 		}()
 	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		// Stop the listeners and drain the clients before exiting
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+		sig := <-sigChan
+		logger.Info("Shutting down", "signal", sig)
+		if err := serv.Shutdown(c.Duration("shutdown-timeout")); err != nil {
+			logger.Warn("Shutdown incomplete", "error", err)
+		}
+		close(shutdownDone)
+	}()
+	// The servers return once Shutdown closed their listeners
 	wg.Wait()
+	<-shutdownDone
 }
 
 func main() {
 	app := cli.NewApp()
 	app.Name = "skyproxy"
-	app.Version = "0.1.0"
+	app.Version = utils.Version
 	app.Usage = "Reverse tunnel HTTP proxy"
 	app.Commands = globalCommands()
 	app.Run(os.Args)
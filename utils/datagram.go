@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxDatagramSize is the largest UDP payload tunneled
+const MaxDatagramSize = 65535
+
+// The datagrams of a UDP flow are tunneled over a stream, each one prefixed
+// by its length on 2 bytes. The server sends the source address of the flow
+// as the first frame.
+
+// WriteDatagram writes a frame in a single Write
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > MaxDatagramSize {
+		return fmt.Errorf("Datagram too large (%d bytes)", len(b))
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads a frame into buf, which must hold MaxDatagramSize bytes
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	return io.ReadFull(r, buf[:n])
+}
@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"net"
+	"strings"
+)
+
+// NormalizeHost removes the port and the trailing dot of a host and
+// lowercases it, so "WWW.Domain.tld.:8080" becomes "www.domain.tld"
+func NormalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// IsWildcardHost tells whether a host is a wildcard: "*" matches any host and
+// "*.domain.tld" matches any sub-domain of domain.tld
+func IsWildcardHost(host string) bool {
+	return host == "*" || strings.HasPrefix(host, "*.")
+}
+
+// ValidHostPattern checks that a registered host is either a host name or a
+// wildcard, a "*" is only allowed as the first label
+func ValidHostPattern(host string) bool {
+	if host == "" {
+		return false
+	}
+	if IsWildcardHost(host) {
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+		if host == "" {
+			return true
+		}
+	}
+	return !strings.ContainsAny(host, "*/ ")
+}
+
+// HostPatterns returns the registered hosts that can match a host, from the
+// most specific to the least specific: the host itself, then the wildcards of
+// its parent domains and finally "*"
+func HostPatterns(host string) []string {
+	patterns := []string{host}
+	for idx := strings.Index(host, "."); idx >= 0; idx = strings.Index(host, ".") {
+		host = host[idx+1:]
+		if host == "" {
+			break
+		}
+		patterns = append(patterns, "*."+host)
+	}
+	return append(patterns, "*")
+}
@@ -0,0 +1,101 @@
+package utils
+
+import (
+	"bufio"
+	"net"
+)
+
+const (
+	// Version is the version of Skyproxy
+	Version = "0.1.0"
+	// ProtocolVersion is the version of the registration handshake, the server
+	// rejects the clients using a different version
+	ProtocolVersion = 1
+	// ProtocolName is used in the Upgrade header of the handshake
+	ProtocolName = "skyproxy"
+)
+
+// Headers sent by the client with the registration request
+const (
+	ClientVersionHeader   = "X-Skyproxy-Client-Version"
+	ProtocolVersionHeader = "X-Skyproxy-Protocol-Version"
+	// HostsHeader lists the hosts to register, separated by commas
+	HostsHeader = "X-Skyproxy-Hosts"
+	// WeightHeader is the weight of the client for the weighted balancer
+	WeightHeader = "X-Skyproxy-Weight"
+	// HealthPathHeader is the path requested by the server health checks
+	HealthPathHeader = "X-Skyproxy-Health-Path"
+	// ModeHeader is the kind of traffic tunneled to the client (ModeHTTP by
+	// default)
+	ModeHeader = "X-Skyproxy-Mode"
+	// TCPPortHeader is the port requested by a TCP client, 0 lets the server
+	// assign a port
+	TCPPortHeader = "X-Skyproxy-TCP-Port"
+	// UDPPortHeader is the port requested by a UDP client, 0 lets the server
+	// assign a port
+	UDPPortHeader = "X-Skyproxy-UDP-Port"
+)
+
+// Tunnel modes
+const (
+	// ModeHTTP tunnels the requests for the registered hosts
+	ModeHTTP = "http"
+	// ModeTCP tunnels the connections to a TCP port of the server
+	ModeTCP = "tcp"
+	// ModeTLS tunnels the TLS connections for the registered hosts without
+	// terminating them (SNI passthrough)
+	ModeTLS = "tls"
+	// ModeUDP tunnels the datagrams sent to a UDP port of the server, each
+	// flow (source address) gets its own stream
+	ModeUDP = "udp"
+)
+
+// Reasons sent by the server when it rejects a registration
+const (
+	RejectInvalidRequest     = "invalid_request"
+	RejectUnsupportedVersion = "unsupported_version"
+	RejectInternalError      = "internal_error"
+	RejectUnauthorized       = "unauthorized"
+	RejectForbiddenHost      = "forbidden_host"
+	RejectShuttingDown       = "shutting_down"
+	RejectUnavailablePort    = "unavailable_port"
+)
+
+// RegisterLimits are the limits applied by the server to a client session
+type RegisterLimits struct {
+	// MaxPendingStreams is the number of streams the server can open without
+	// waiting for the client to accept them
+	MaxPendingStreams int `json:"max_pending_streams"`
+	// KeepAliveInterval is the interval between two pings, in seconds
+	KeepAliveInterval int `json:"keepalive_interval"`
+}
+
+// RegisterResponse is the JSON body of the server reply to a registration
+// request. When the registration is accepted, the status code is 101
+// (Switching Protocols) and the connection is used by the Yamux session right
+// after the body.
+type RegisterResponse struct {
+	Accepted        bool            `json:"accepted"`
+	ProtocolVersion int             `json:"protocol_version"`
+	ServerVersion   string          `json:"server_version"`
+	SessionID       string          `json:"session_id,omitempty"`
+	Hosts           []string        `json:"hosts,omitempty"`
+	TCPPort         int             `json:"tcp_port,omitempty"`
+	UDPPort         int             `json:"udp_port,omitempty"`
+	Limits          *RegisterLimits `json:"limits,omitempty"`
+	// Code and Reason explain why the registration is rejected
+	Code   string `json:"code,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// BufferedConn is a net.Conn reading through a bufio.Reader, it is used to
+// hand over a connection after reading the handshake without losing any
+// buffered data
+type BufferedConn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func (c *BufferedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
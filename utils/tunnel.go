@@ -2,33 +2,58 @@ package utils
 
 import (
 	"io"
-	"log"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // TunnelConn is a low level function which takes two connections and tunnel
-// one to the other. It also handles the traffic back.
-func TunnelConn(from, to net.Conn, closeConns bool) {
-	id := time.Now().Nanosecond()
+// one to the other. It also handles the traffic back. It returns the number of
+// bytes written to each connection.
+func TunnelConn(from, to net.Conn, closeConns bool) (fromBytes, toBytes int64) {
 	var wg sync.WaitGroup
-	tunnelCopy := func(label string, from, to net.Conn) {
+	tunnelCopy := func(from, to net.Conn, written *int64) {
 		defer wg.Done()
 		if closeConns {
 			defer from.Close()
 			defer to.Close()
 		}
-		log.Printf("TunnelConn(%d),%s: open", id, label)
-		nWrittenBytes, err := io.Copy(from, to)
-		if err != nil {
-			log.Printf("TunnelConn(%d),%s: %s", id, label, err)
-		} else {
-			log.Printf("TunnelConn(%d),%s: %d bytes copied", id, label, nWrittenBytes)
-		}
+		*written, _ = io.Copy(from, to)
 	}
 	wg.Add(2)
-	go tunnelCopy("receive", to, from)
-	go tunnelCopy("send", from, to)
+	go tunnelCopy(to, from, &toBytes)
+	go tunnelCopy(from, to, &fromBytes)
 	wg.Wait()
+	return fromBytes, toBytes
+}
+
+// idleConn postpones the idle timer on each read
+type idleConn struct {
+	net.Conn
+	timer   *time.Timer
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+// TunnelConnTimeout is like TunnelConn, both connections are closed once no
+// data is read from either of them during idleTimeout. timedOut tells whether
+// the tunnel ended because of the timeout.
+func TunnelConnTimeout(from, to net.Conn, idleTimeout time.Duration) (fromBytes, toBytes int64, timedOut bool) {
+	var expired int32
+	timer := time.AfterFunc(idleTimeout, func() {
+		atomic.StoreInt32(&expired, 1)
+		from.Close()
+		to.Close()
+	})
+	defer timer.Stop()
+	fromBytes, toBytes = TunnelConn(&idleConn{from, timer, idleTimeout}, &idleConn{to, timer, idleTimeout}, true)
+	return fromBytes, toBytes, atomic.LoadInt32(&expired) == 1
 }